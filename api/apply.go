@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// fieldManager is the field manager recorded for every write of the API.
+const fieldManager = "kaasapi"
+
+// applyDeployment declaratively applies every object generated for req with
+// server-side apply. Applying the same request twice is a no-op, fields
+// drifted from req are taken back, and objects req no longer asks for are
+// removed. Replicas are left alone when another manager, such as an HPA,
+// owns them.
+func applyDeployment(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	kind, err := liveWorkloadKind(clientset, namespace, req.AppName)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err == nil && kind != workloadKind(req) {
+		return errWorkloadKindChanged
+	}
+	if err == nil && kind == "statefulset" {
+		err = checkStatefulSetDisk(clientset, namespace, req)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = checkHostCollisions(clientset, namespace, req)
+	if err != nil {
+		return err
+	}
+
+	// applying would overwrite the service selector a blue/green release
+	// may have switched and leave the release behind
+	release, err := getRelease(clientset, namespace, req.AppName)
+	if err != nil {
+		return err
+	}
+	if release != nil {
+		return errReleaseInProgress
+	}
+
+	service := buildService(req)
+	live, err := clientset.CoreV1().Services(namespace).Get(context.TODO(), service.Name, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error fetching service: %w", err)
+	}
+	if err == nil && serviceRecreateRequired(live, service) {
+		err = deleteObject(clientset, namespace, "service", service.Name)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	err = applyObject(service, corev1.SchemeGroupVersion.WithKind("Service"), func(data []byte, opts metav1.PatchOptions) error {
+		_, err := clientset.CoreV1().Services(namespace).Patch(context.TODO(), service.Name, types.ApplyPatchType, data, opts)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error applying service: %w", err)
+	}
+
+	if req.ExternalAccess && uploadsCertificate(req) {
+		tlsSecret := buildTLSSecret(req)
+		err = applyObject(tlsSecret, corev1.SchemeGroupVersion.WithKind("Secret"), func(data []byte, opts metav1.PatchOptions) error {
+			_, err := clientset.CoreV1().Secrets(namespace).Patch(context.TODO(), tlsSecret.Name, types.ApplyPatchType, data, opts)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error applying TLS secret: %w", err)
+		}
+	} else {
+		err = reconcileTLSSecret(clientset, namespace, req)
+		if err != nil {
+			return err
+		}
+	}
+
+	if usesBasicAuth(req) {
+		live, err := clientset.CoreV1().Secrets(namespace).Get(context.TODO(), basicAuthSecretName(req.AppName), metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			live = nil
+		} else if err != nil {
+			return fmt.Errorf("error fetching basic auth secret: %w", err)
+		}
+		basicAuthSecret, err := buildBasicAuthSecret(req, live)
+		if err != nil {
+			return err
+		}
+		err = applyObject(basicAuthSecret, corev1.SchemeGroupVersion.WithKind("Secret"), func(data []byte, opts metav1.PatchOptions) error {
+			_, err := clientset.CoreV1().Secrets(namespace).Patch(context.TODO(), basicAuthSecret.Name, types.ApplyPatchType, data, opts)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error applying basic auth secret: %w", err)
+		}
+	} else {
+		err = deleteObject(clientset, namespace, "secret", basicAuthSecretName(req.AppName))
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	if req.ExternalAccess {
+		ingress := buildIngress(req)
+		err = applyObject(ingress, networkingv1.SchemeGroupVersion.WithKind("Ingress"), func(data []byte, opts metav1.PatchOptions) error {
+			_, err := clientset.NetworkingV1().Ingresses(namespace).Patch(context.TODO(), ingress.Name, types.ApplyPatchType, data, opts)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error applying ingress: %w", err)
+		}
+	} else {
+		err = deleteObject(clientset, namespace, "ingress", ingressName(req.AppName))
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	if len(req.Secrets) > 0 {
+		secret := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: secretName(req.AppName),
+			},
+			Data: make(map[string][]byte),
+		}
+		for k, v := range keyValueMap(req.Secrets) {
+			secret.Data[k] = []byte(v)
+		}
+		err = applyObject(secret, corev1.SchemeGroupVersion.WithKind("Secret"), func(data []byte, opts metav1.PatchOptions) error {
+			_, err := clientset.CoreV1().Secrets(namespace).Patch(context.TODO(), secret.Name, types.ApplyPatchType, data, opts)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error applying secret: %w", err)
+		}
+	} else {
+		err = deleteObject(clientset, namespace, "secret", secretName(req.AppName))
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	if len(req.Envs) > 0 {
+		configMap := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: configMapName(req.AppName),
+			},
+			Data: keyValueMap(req.Envs),
+		}
+		err = applyObject(configMap, corev1.SchemeGroupVersion.WithKind("ConfigMap"), func(data []byte, opts metav1.PatchOptions) error {
+			_, err := clientset.CoreV1().ConfigMaps(namespace).Patch(context.TODO(), configMap.Name, types.ApplyPatchType, data, opts)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error applying config map: %w", err)
+		}
+	} else {
+		err = deleteObject(clientset, namespace, "configmap", configMapName(req.AppName))
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	err = snapshotConfig(clientset, namespace, req)
+	if err != nil {
+		return err
+	}
+
+	if usesStatefulSet(req) {
+		err = applyStatefulSet(clientset, namespace, req)
+	} else {
+		err = applyDeploymentObject(clientset, namespace, req)
+	}
+	if err != nil {
+		return err
+	}
+
+	if req.Autoscaling != nil {
+		hpa := buildHPA(req)
+		err = applyObject(hpa, autoscalingv2.SchemeGroupVersion.WithKind("HorizontalPodAutoscaler"), func(data []byte, opts metav1.PatchOptions) error {
+			_, err := clientset.AutoscalingV2().HorizontalPodAutoscalers(namespace).Patch(context.TODO(), hpa.Name, types.ApplyPatchType, data, opts)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error applying autoscaler: %w", err)
+		}
+	} else {
+		err = deleteObject(clientset, namespace, "horizontalpodautoscaler", hpaName(req.AppName))
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return pruneSnapshots(clientset, namespace, req.AppName)
+}
+
+func applyDeploymentObject(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	if req.Resources.Disk != "" {
+		claim := buildDataClaim(req)
+		err := applyObject(claim, corev1.SchemeGroupVersion.WithKind("PersistentVolumeClaim"), func(data []byte, opts metav1.PatchOptions) error {
+			_, err := clientset.CoreV1().PersistentVolumeClaims(namespace).Patch(context.TODO(), claim.Name, types.ApplyPatchType, data, opts)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("error applying persistent volume claim: %w", err)
+		}
+	}
+
+	deploymentsClient := clientset.AppsV1().Deployments(namespace)
+	deployment := buildDeployment(req)
+
+	live, err := deploymentsClient.Get(context.TODO(), req.AppName, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error fetching deployment: %w", err)
+	}
+	if err == nil && (req.Autoscaling != nil || managedByOthers(live.ManagedFields, "spec", "replicas")) {
+		deployment.Spec.Replicas = nil
+	}
+
+	err = applyObject(deployment, appsv1.SchemeGroupVersion.WithKind("Deployment"), func(data []byte, opts metav1.PatchOptions) error {
+		fmt.Println("Applying deployment...")
+		_, err := deploymentsClient.Patch(context.TODO(), deployment.Name, types.ApplyPatchType, data, opts)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error applying deployment: %w", err)
+	}
+
+	return nil
+}
+
+func applyStatefulSet(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	statefulSetsClient := clientset.AppsV1().StatefulSets(namespace)
+	statefulSet := buildStatefulSet(req)
+
+	live, err := statefulSetsClient.Get(context.TODO(), req.AppName, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error fetching statefulset: %w", err)
+	}
+	if err == nil && (req.Autoscaling != nil || managedByOthers(live.ManagedFields, "spec", "replicas")) {
+		statefulSet.Spec.Replicas = nil
+	}
+
+	err = applyObject(statefulSet, appsv1.SchemeGroupVersion.WithKind("StatefulSet"), func(data []byte, opts metav1.PatchOptions) error {
+		fmt.Println("Applying statefulset...")
+		_, err := statefulSetsClient.Patch(context.TODO(), statefulSet.Name, types.ApplyPatchType, data, opts)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("error applying statefulset: %w", err)
+	}
+
+	return nil
+}
+
+// applyObject encodes obj as an apply configuration of kind gvk and hands it
+// to patch. Conflicts are forced, so the API always takes back the fields it
+// declares.
+func applyObject(obj runtime.Object, gvk schema.GroupVersionKind, patch func(data []byte, opts metav1.PatchOptions) error) error {
+	obj.GetObjectKind().SetGroupVersionKind(gvk)
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return err
+	}
+
+	// Typed objects always carry these, but they are not part of the intent
+	// and would otherwise be claimed by the API.
+	delete(content, "status")
+	unstructured.RemoveNestedField(content, "metadata", "creationTimestamp")
+	unstructured.RemoveNestedField(content, "spec", "template", "metadata", "creationTimestamp")
+	// secrets and config maps have no spec, indexing the nil map is fine
+	spec, _ := content["spec"].(map[string]interface{})
+	if claims, ok := spec["volumeClaimTemplates"].([]interface{}); ok {
+		for _, claim := range claims {
+			claim := claim.(map[string]interface{})
+			delete(claim, "status")
+			unstructured.RemoveNestedField(claim, "metadata", "creationTimestamp")
+		}
+	}
+
+	data, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+
+	force := true
+	return patch(data, metav1.PatchOptions{
+		FieldManager: fieldManager,
+		Force:        &force,
+	})
+}
+
+// managedByOthers reports whether the field at path is owned by a manager
+// other than the API according to managedFields.
+func managedByOthers(managedFields []metav1.ManagedFieldsEntry, path ...string) bool {
+	for _, entry := range managedFields {
+		if entry.Manager == fieldManager || entry.FieldsV1 == nil {
+			continue
+		}
+
+		var fields map[string]interface{}
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			continue
+		}
+
+		found := true
+		for _, key := range path {
+			next, ok := fields["f:"+key].(map[string]interface{})
+			if !ok {
+				found = false
+				break
+			}
+			fields = next
+		}
+		if found {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+const apiKeyHeader = "X-API-Key"
+
+// AuthConfig holds the credentials callers can authenticate with. API keys
+// map directly to a tenant, JWT bearer tokens carry the tenant in a claim.
+type AuthConfig struct {
+	APIKeys     map[string]string
+	JWTSecret   []byte
+	JWTIssuer   string
+	TenantClaim string
+}
+
+// loadAuthConfig reads the authentication settings from the environment.
+// API_KEYS is a comma separated list of key:tenant pairs.
+func loadAuthConfig() (*AuthConfig, error) {
+	config := &AuthConfig{
+		APIKeys:     make(map[string]string),
+		JWTSecret:   []byte(os.Getenv("JWT_SECRET")),
+		JWTIssuer:   os.Getenv("JWT_ISSUER"),
+		TenantClaim: os.Getenv("JWT_TENANT_CLAIM"),
+	}
+	if config.TenantClaim == "" {
+		config.TenantClaim = "tenant"
+	}
+
+	for _, entry := range strings.Split(os.Getenv("API_KEYS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, tenant, ok := strings.Cut(entry, ":")
+		if !ok || key == "" || tenant == "" {
+			return nil, fmt.Errorf("invalid API_KEYS entry, expected key:tenant")
+		}
+		config.APIKeys[key] = tenant
+	}
+
+	if len(config.APIKeys) == 0 && len(config.JWTSecret) == 0 {
+		return nil, fmt.Errorf("no authentication configured, set API_KEYS or JWT_SECRET")
+	}
+
+	return config, nil
+}
+
+// authMiddleware authenticates the caller with either an API key or a JWT
+// bearer token and stores the tenant it belongs to in the echo context.
+func authMiddleware(config *AuthConfig) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			var tenant string
+			var err error
+
+			if key := c.Request().Header.Get(apiKeyHeader); key != "" {
+				tenant, err = config.apiKeyTenant(key)
+			} else if token, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer "); ok {
+				tenant, err = config.tokenTenant(token)
+			} else {
+				err = fmt.Errorf("missing credentials")
+			}
+
+			if err != nil {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+				return c.String(http.StatusUnauthorized, fmt.Sprintf("Unauthorized: %v", err))
+			}
+
+			c.Set(tenantKey, tenant)
+			return next(c)
+		}
+	}
+}
+
+func (config *AuthConfig) apiKeyTenant(key string) (string, error) {
+	// compare against every key so the time taken does not leak a match
+	tenant := ""
+	for candidate, candidateTenant := range config.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(key)) == 1 {
+			tenant = candidateTenant
+		}
+	}
+	if tenant == "" {
+		return "", fmt.Errorf("invalid API key")
+	}
+	return tenant, nil
+}
+
+func (config *AuthConfig) tokenTenant(tokenString string) (string, error) {
+	if len(config.JWTSecret) == 0 {
+		return "", fmt.Errorf("bearer tokens are not accepted")
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"HS256", "HS384", "HS512"}),
+		jwt.WithExpirationRequired(),
+	}
+	if config.JWTIssuer != "" {
+		options = append(options, jwt.WithIssuer(config.JWTIssuer))
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		return config.JWTSecret, nil
+	}, options...)
+	if err != nil {
+		return "", fmt.Errorf("invalid token: %v", err)
+	}
+
+	tenant, ok := claims[config.TenantClaim].(string)
+	if !ok || tenant == "" {
+		return "", fmt.Errorf("token has no %s claim", config.TenantClaim)
+	}
+	return tenant, nil
+}
+
+func tenantOf(c echo.Context) string {
+	return c.Get(tenantKey).(string)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// buildContainer builds a sidecar or init container declared next to the
+// app container.
+func buildContainer(request *ContainerRequest) corev1.Container {
+	container := corev1.Container{
+		Name:         request.Name,
+		Image:        fmt.Sprintf("%s:%s", request.ImageAddress, request.ImageTag),
+		Command:      request.Command,
+		Args:         request.Args,
+		Resources:    resourceRequirements(&request.Resources),
+		VolumeMounts: buildVolumeMounts(request.VolumeMounts),
+	}
+	for _, kv := range request.Envs {
+		container.Env = append(container.Env, corev1.EnvVar{
+			Name:  kv.Key,
+			Value: kv.Value,
+		})
+	}
+	return container
+}
+
+func buildVolumeMounts(mounts []VolumeMountRequest) []corev1.VolumeMount {
+	var volumeMounts []corev1.VolumeMount
+	for _, mount := range mounts {
+		volumeMounts = append(volumeMounts, corev1.VolumeMount{
+			Name:      mount.Name,
+			MountPath: mount.MountPath,
+			ReadOnly:  mount.ReadOnly,
+		})
+	}
+	return volumeMounts
+}
+
+// buildSharedVolumes builds the emptyDir volumes the containers of a pod
+// share, such as a log directory read by a shipper.
+func buildSharedVolumes(volumes []SharedVolumeRequest) []corev1.Volume {
+	var result []corev1.Volume
+	for _, volume := range volumes {
+		emptyDir := &corev1.EmptyDirVolumeSource{
+			Medium: corev1.StorageMedium(volume.Medium),
+		}
+		if volume.SizeLimit != "" {
+			sizeLimit := resourceQuantity(volume.SizeLimit)
+			emptyDir.SizeLimit = &sizeLimit
+		}
+		result = append(result, corev1.Volume{
+			Name: volume.Name,
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: emptyDir,
+			},
+		})
+	}
+	return result
+}
+
+// expandResourcePresets expands the presets of the app container and of
+// every sidecar and init container of req.
+func expandResourcePresets(req *DeploymentRequest) {
+	expandResourcePreset(&req.Resources)
+	for i := range req.Sidecars {
+		expandResourcePreset(&req.Sidecars[i].Resources)
+	}
+	for i := range req.InitContainers {
+		expandResourcePreset(&req.InitContainers[i].Resources)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// deleteApp removes the Deployment or StatefulSet of appName together with
+// every object derived from it. Data volumes, whether claimed by the
+// Deployment or by a StatefulSet, are only removed when purgeVolumes is set,
+// otherwise they are reported as retained.
+func deleteApp(clientset *kubernetes.Clientset, namespace string, appName string, purgeVolumes bool) (*DeleteResult, error) {
+	result := &DeleteResult{
+		AppName: appName,
+		Deleted: make([]string, 0),
+	}
+
+	var statefulSet *appsv1.StatefulSet
+	err := deleteObject(clientset, namespace, "deployment", appName)
+	if err == nil {
+		result.Deleted = append(result.Deleted, "deployment/"+appName)
+	} else if apierrors.IsNotFound(err) {
+		statefulSet, err = clientset.AppsV1().StatefulSets(namespace).Get(context.TODO(), appName, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("app not found: %w", err)
+		}
+		err = deleteObject(clientset, namespace, "statefulset", appName)
+		if err != nil {
+			return nil, err
+		}
+		result.Deleted = append(result.Deleted, "statefulset/"+appName)
+	} else {
+		return nil, err
+	}
+
+	release, err := getRelease(clientset, namespace, appName)
+	if err != nil {
+		return result, err
+	}
+	if release != nil {
+		err = deleteIfExists(clientset, namespace, result, "deployment", release.Name)
+		if err != nil {
+			return result, err
+		}
+		if release.Labels[releaseStrategyLabel] == releaseCanary {
+			err = deleteIfExists(clientset, namespace, result, "ingress", ingressName(release.Name))
+			if err != nil {
+				return result, err
+			}
+			err = deleteIfExists(clientset, namespace, result, "service", serviceName(release.Name))
+			if err != nil {
+				return result, err
+			}
+		}
+	}
+
+	derived := []createdObject{
+		{kind: "service", name: serviceName(appName)},
+		{kind: "ingress", name: ingressName(appName)},
+		{kind: "secret", name: tlsSecretName(appName)},
+		{kind: "secret", name: basicAuthSecretName(appName)},
+		{kind: "secret", name: secretName(appName)},
+		{kind: "configmap", name: configMapName(appName)},
+		{kind: "horizontalpodautoscaler", name: hpaName(appName)},
+	}
+	for _, object := range derived {
+		err = deleteIfExists(clientset, namespace, result, object.kind, object.name)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	snapshots, err := listSnapshots(clientset, namespace, appName)
+	if err != nil {
+		return result, err
+	}
+	for _, snapshot := range snapshots {
+		err = deleteIfExists(clientset, namespace, result, snapshot.kind, snapshot.name)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	var claims []string
+	if statefulSet != nil {
+		claims, err = statefulSetClaims(clientset, namespace, statefulSet)
+		if err != nil {
+			return result, err
+		}
+	} else {
+		_, err = clientset.CoreV1().PersistentVolumeClaims(namespace).Get(context.TODO(), dataClaimName(appName), metav1.GetOptions{})
+		if err == nil {
+			claims = append(claims, dataClaimName(appName))
+		} else if !apierrors.IsNotFound(err) {
+			return result, fmt.Errorf("error fetching persistent volume claim: %w", err)
+		}
+	}
+	for _, claim := range claims {
+		if !purgeVolumes {
+			result.RetainedVolumes = append(result.RetainedVolumes, "persistentvolumeclaim/"+claim)
+			continue
+		}
+		err = deleteIfExists(clientset, namespace, result, "persistentvolumeclaim", claim)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// deleteIfExists deletes kind/name and records it in result unless it was
+// already gone.
+func deleteIfExists(clientset *kubernetes.Clientset, namespace string, result *DeleteResult, kind string, name string) error {
+	err := deleteObject(clientset, namespace, kind, name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	result.Deleted = append(result.Deleted, kind+"/"+name)
+	return nil
+}
+
+// statefulSetClaims lists the claims the StatefulSet controller created from
+// the volume claim templates of statefulSet, named <template>-<set>-<ordinal>.
+func statefulSetClaims(clientset *kubernetes.Clientset, namespace string, statefulSet *appsv1.StatefulSet) ([]string, error) {
+	pvcList, err := clientset.CoreV1().PersistentVolumeClaims(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing persistent volume claims: %w", err)
+	}
+
+	claims := make([]string, 0)
+	for _, pvc := range pvcList.Items {
+		for _, template := range statefulSet.Spec.VolumeClaimTemplates {
+			prefix := template.Name + "-" + statefulSet.Name + "-"
+			ordinal := strings.TrimPrefix(pvc.Name, prefix)
+			if ordinal == pvc.Name {
+				continue
+			}
+			if _, err := strconv.Atoi(ordinal); err == nil {
+				claims = append(claims, pvc.Name)
+				break
+			}
+		}
+	}
+
+	return claims, nil
+}
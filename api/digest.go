@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	imageTagAnnotation    = "kaasapi/image-tag"
+	imageDigestAnnotation = "kaasapi/image-digest"
+
+	dockerHubRegistry = "registry-1.docker.io"
+)
+
+// manifestMediaTypes are the manifests a tag may point to. Multi-platform
+// images resolve to the digest of their index, which is what the kubelet
+// pulls by as well.
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+var (
+	// errImageNotFound is returned when the registry does not know the tag.
+	errImageNotFound = errors.New("image not found")
+
+	// errRealmNotAllowed is returned for token realms credentials are not
+	// sent to.
+	errRealmNotAllowed = errors.New("registry token realm is not allowed")
+
+	authParamRegexp = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+// RegistryConfig holds the registries digests are resolved against over
+// plain HTTP, like a local registry used for testing.
+type RegistryConfig struct {
+	InsecureRegistries []string
+	Timeout            time.Duration
+}
+
+var registryConfig = RegistryConfig{
+	Timeout: 10 * time.Second,
+}
+
+func loadRegistryConfig() {
+	for _, host := range strings.Split(os.Getenv("INSECURE_REGISTRIES"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			registryConfig.InsecureRegistries = append(registryConfig.InsecureRegistries, host)
+		}
+	}
+}
+
+// parseImageAddress splits an image address into the registry host and the
+// repository, following the docker conventions: the first component is a
+// host only if it looks like one, and official images live under library/.
+func parseImageAddress(address string) (host string, repository string) {
+	host, repository, found := strings.Cut(address, "/")
+	if !found || (!strings.ContainsAny(host, ".:") && host != "localhost") {
+		host, repository = dockerHubRegistry, address
+	}
+	host = normalizeRegistryHost(host)
+	if host == dockerHubRegistry && !strings.Contains(repository, "/") {
+		repository = "library/" + repository
+	}
+	return host, repository
+}
+
+// normalizeRegistryHost maps the ways a registry is written in image
+// addresses and docker configs onto the host its API is served from.
+func normalizeRegistryHost(server string) string {
+	server = strings.TrimPrefix(server, "https://")
+	server = strings.TrimPrefix(server, "http://")
+	server, _, _ = strings.Cut(server, "/")
+	switch server {
+	case "docker.io", "index.docker.io":
+		return dockerHubRegistry
+	}
+	return server
+}
+
+// pinImageDigest resolves the tag of req to the digest it currently points
+// to, so the app keeps running that exact image until it is redeployed.
+func pinImageDigest(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	if !req.PinDigest {
+		return nil
+	}
+
+	host, repository := parseImageAddress(req.ImageAddress)
+	username, password, err := registryCredentials(clientset, namespace, req.ImagePullSecrets, host)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Resolving image digest...")
+	digest, err := resolveImageDigest(host, repository, req.ImageTag, username, password)
+	if err != nil {
+		return fmt.Errorf("error resolving %s:%s: %w", req.ImageAddress, req.ImageTag, err)
+	}
+	req.ImageDigest = digest
+
+	return nil
+}
+
+// registryCredentials returns the credentials for host among the registry
+// credentials names, or empty ones to pull anonymously.
+func registryCredentials(clientset *kubernetes.Clientset, namespace string, names []string, host string) (string, string, error) {
+	for _, name := range names {
+		secret, err := getRegistrySecret(clientset, namespace, name)
+		if err != nil {
+			return "", "", fmt.Errorf("error fetching registry credential %s: %w", name, err)
+		}
+		var config dockerConfigJSON
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &config); err != nil {
+			return "", "", fmt.Errorf("error decoding registry credential %s: %v", name, err)
+		}
+		for server, entry := range config.Auths {
+			if normalizeRegistryHost(server) == host {
+				return entry.Username, entry.Password, nil
+			}
+		}
+	}
+	return "", "", nil
+}
+
+// resolveImageDigest asks the registry v2 API for the digest of the
+// manifest tag points to, authenticating with a bearer token or basic auth
+// as the registry challenges.
+func resolveImageDigest(host string, repository string, tag string, username string, password string) (string, error) {
+	scheme := "https"
+	if slices.Contains(registryConfig.InsecureRegistries, host) {
+		scheme = "http"
+	}
+	manifestURL := fmt.Sprintf("%s://%s/v2/%s/manifests/%s", scheme, host, repository, tag)
+	client := &http.Client{Timeout: registryConfig.Timeout}
+
+	resp, err := fetchManifest(client, http.MethodHead, manifestURL, "")
+	if err != nil {
+		return "", err
+	}
+	authorization := ""
+	if resp.StatusCode == http.StatusUnauthorized {
+		authorization, err = registryAuthorization(client, resp.Header.Get("WWW-Authenticate"), repository, username, password)
+		if err != nil {
+			return "", err
+		}
+		resp, err = fetchManifest(client, http.MethodHead, manifestURL, authorization)
+		if err != nil {
+			return "", err
+		}
+	}
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+
+	// some registries leave the digest header out of HEAD responses, so the
+	// manifest is fetched and hashed instead
+	resp, err = fetchManifest(client, http.MethodGet, manifestURL, authorization)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading manifest: %v", err)
+	}
+	sum := sha256.Sum256(body)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// fetchManifest requests the manifest at manifestURL, failing unless the
+// registry answers with it. HEAD responses are returned with their body
+// closed.
+func fetchManifest(client *http.Client, method string, manifestURL string, authorization string) (*http.Response, error) {
+	request, err := http.NewRequest(method, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("error contacting registry: %v", err)
+	}
+	if method == http.MethodHead || resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return resp, nil
+	case resp.StatusCode == http.StatusUnauthorized && method == http.MethodHead && authorization == "":
+		return resp, nil
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, errImageNotFound
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, fmt.Errorf("registry denied access to %s", manifestURL)
+	default:
+		return nil, fmt.Errorf("registry answered %s", resp.Status)
+	}
+}
+
+// registryAuthorization answers the WWW-Authenticate challenge of a
+// registry with the Authorization header to retry with.
+func registryAuthorization(client *http.Client, challenge string, repository string, username string, password string) (string, error) {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if username == "" {
+			return "", fmt.Errorf("registry requires credentials")
+		}
+		request, _ := http.NewRequest(http.MethodGet, "/", nil)
+		request.SetBasicAuth(username, password)
+		return request.Header.Get("Authorization"), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("unsupported registry authentication %q", scheme)
+	}
+
+	values := make(map[string]string)
+	for _, match := range authParamRegexp.FindAllStringSubmatch(params, -1) {
+		values[match[1]] = match[2]
+	}
+	if values["realm"] == "" {
+		return "", fmt.Errorf("registry challenge has no realm")
+	}
+
+	query := url.Values{}
+	if values["service"] != "" {
+		query.Set("service", values["service"])
+	}
+	scope := values["scope"]
+	if scope == "" {
+		scope = fmt.Sprintf("repository:%s:pull", repository)
+	}
+	query.Set("scope", scope)
+
+	client, err := tokenClient(client, values["realm"])
+	if err != nil {
+		return "", err
+	}
+	request, err := http.NewRequest(http.MethodGet, values["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", fmt.Errorf("error building token request: %v", err)
+	}
+	if username != "" {
+		request.SetBasicAuth(username, password)
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("error fetching registry token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("registry token request answered %s", resp.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("error decoding registry token: %v", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+
+	return "Bearer " + token.Token, nil
+}
+
+// imageReference is the image the app container runs, pinned to its digest
+// when one was resolved.
+func imageReference(req *DeploymentRequest) string {
+	if req.ImageDigest != "" {
+		return fmt.Sprintf("%s@%s", req.ImageAddress, req.ImageDigest)
+	}
+	return fmt.Sprintf("%s:%s", req.ImageAddress, req.ImageTag)
+}
+
+// imageAnnotations record the tag a pinned image was resolved from, since
+// the image of the container only names its digest.
+func imageAnnotations(req *DeploymentRequest) map[string]string {
+	if req.ImageDigest == "" {
+		return nil
+	}
+	return map[string]string{
+		imageTagAnnotation:    req.ImageTag,
+		imageDigestAnnotation: req.ImageDigest,
+	}
+}
+
+// templateImage returns the image, tag and digest the app container of
+// template runs.
+func templateImage(appName string, template *corev1.PodTemplateSpec) (image string, tag string, digest string) {
+	container := appContainer(appName, template)
+	if container == nil {
+		return "", "", ""
+	}
+	image = container.Image
+	if template.Annotations[imageDigestAnnotation] != "" {
+		return image, template.Annotations[imageTagAnnotation], template.Annotations[imageDigestAnnotation]
+	}
+
+	name, digest, _ := strings.Cut(image, "@")
+	// a colon after the last slash separates the tag, not a registry port
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		tag = name[i+1:]
+	}
+	return image, tag, digest
+}
+
+// tokenClient returns the client to fetch a token from realm with. The realm
+// is named by the registry, so unless its host is listed as an insecure
+// registry it must be served over HTTPS from a public address. Otherwise a
+// registry could point the API, and the credentials it sends, at services
+// inside the cluster.
+func tokenClient(client *http.Client, realm string) (*http.Client, error) {
+	realmURL, err := url.Parse(realm)
+	if err != nil || realmURL.Host == "" {
+		return nil, fmt.Errorf("%w: %q", errRealmNotAllowed, realm)
+	}
+	if slices.Contains(registryConfig.InsecureRegistries, realmURL.Host) {
+		return client, nil
+	}
+	if realmURL.Scheme != "https" {
+		return nil, fmt.Errorf("%w: %s is not served over HTTPS", errRealmNotAllowed, realm)
+	}
+
+	// the address is checked when connecting rather than when resolving,
+	// so the host cannot resolve differently in between
+	dialer := &net.Dialer{
+		Timeout: registryConfig.Timeout,
+		Control: func(network string, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicAddress(ip) {
+				return fmt.Errorf("%w: %s resolves to %s", errRealmNotAllowed, realmURL.Host, host)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would be the address connected to instead of the realm
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Timeout:   client.Timeout,
+		Transport: transport,
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			if request.URL.Scheme != "https" {
+				return fmt.Errorf("%w: redirected to %s", errRealmNotAllowed, request.URL.Redacted())
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		},
+	}, nil
+}
+
+// isPublicAddress reports whether ip is reachable from outside the cluster,
+// rather than a loopback, link-local or private address such as those of
+// pods, services and cloud metadata endpoints.
+func isPublicAddress(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsPrivate() && !ip.IsUnspecified() && !ip.IsMulticast()
+}
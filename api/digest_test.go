@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// newTestRegistry starts a registry stand-in serving handler over plain
+// HTTP and registers it as an insecure registry for the test. It returns the
+// host images on it are addressed with.
+func newTestRegistry(t *testing.T, handler http.HandlerFunc) string {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	host := strings.TrimPrefix(server.URL, "http://")
+	saved := registryConfig
+	registryConfig.InsecureRegistries = []string{host}
+	t.Cleanup(func() { registryConfig = saved })
+	return host
+}
+
+func TestResolveImageDigestFromHead(t *testing.T) {
+	host := newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead || r.URL.Path != "/v2/team/app/manifests/v1" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if !strings.Contains(r.Header.Get("Accept"), "application/vnd.oci.image.index.v1+json") {
+			t.Errorf("manifest lists are not accepted: %q", r.Header.Get("Accept"))
+		}
+		w.Header().Set("Docker-Content-Digest", testDigest)
+	})
+
+	digest, err := resolveImageDigest(host, "team/app", "v1", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != testDigest {
+		t.Errorf("digest = %q, want %q", digest, testDigest)
+	}
+}
+
+func TestResolveImageDigestBearerChallenge(t *testing.T) {
+	var realm string
+	host := newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			username, password, ok := r.BasicAuth()
+			if !ok || username != "robot" || password != "s3cret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if scope := r.URL.Query().Get("scope"); scope != "repository:team/app:pull" {
+				t.Errorf("scope = %q", scope)
+			}
+			if service := r.URL.Query().Get("service"); service != "test-registry" {
+				t.Errorf("service = %q", service)
+			}
+			fmt.Fprint(w, `{"token": "t0ken"}`)
+		case "/v2/team/app/manifests/v1":
+			if r.Header.Get("Authorization") != "Bearer t0ken" {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s",service="test-registry",scope="repository:team/app:pull"`, realm))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Docker-Content-Digest", testDigest)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	realm = "http://" + host + "/token"
+
+	digest, err := resolveImageDigest(host, "team/app", "v1", "robot", "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != testDigest {
+		t.Errorf("digest = %q, want %q", digest, testDigest)
+	}
+
+	if _, err := resolveImageDigest(host, "team/app", "v1", "robot", "wrong"); err == nil {
+		t.Error("resolving with wrong credentials succeeded")
+	}
+}
+
+func TestResolveImageDigestRealmElsewhere(t *testing.T) {
+	contacted := false
+	elsewhere := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contacted = true
+		fmt.Fprint(w, `{"token": "t0ken"}`)
+	}))
+	t.Cleanup(elsewhere.Close)
+	elsewhereHost := strings.TrimPrefix(elsewhere.URL, "http://")
+
+	tests := map[string]string{
+		"plain HTTP":      "http://" + elsewhereHost + "/token",
+		"loopback":        "https://" + elsewhereHost + "/token",
+		"link-local":      "https://169.254.169.254/latest/meta-data",
+		"cluster address": "https://10.96.0.1/token",
+		"no host":         "/token",
+	}
+	for name, realm := range tests {
+		t.Run(name, func(t *testing.T) {
+			host := newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s",service="test-registry"`, realm))
+				w.WriteHeader(http.StatusUnauthorized)
+			})
+
+			_, err := resolveImageDigest(host, "team/app", "v1", "robot", "s3cret")
+			if !errors.Is(err, errRealmNotAllowed) {
+				t.Errorf("err = %v, want %v", err, errRealmNotAllowed)
+			}
+			if contacted {
+				t.Error("credentials were sent to the realm")
+			}
+		})
+	}
+}
+
+func TestResolveImageDigestGetFallback(t *testing.T) {
+	manifest := []byte(`{"schemaVersion": 2}`)
+	host := newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		// the digest header is left out, so it has to be computed
+		if r.Method == http.MethodGet {
+			w.Write(manifest)
+		}
+	})
+
+	digest, err := resolveImageDigest(host, "app", "latest", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(manifest)
+	if want := "sha256:" + hex.EncodeToString(sum[:]); digest != want {
+		t.Errorf("digest = %q, want %q", digest, want)
+	}
+}
+
+func TestResolveImageDigestNotFound(t *testing.T) {
+	host := newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	_, err := resolveImageDigest(host, "app", "missing", "", "")
+	if !errors.Is(err, errImageNotFound) {
+		t.Errorf("err = %v, want %v", err, errImageNotFound)
+	}
+}
+
+func TestResolveImageDigestRequiresTLS(t *testing.T) {
+	host := newTestRegistry(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Docker-Content-Digest", testDigest)
+	})
+	// registries not listed as insecure are only reached over HTTPS
+	registryConfig.InsecureRegistries = nil
+
+	if _, err := resolveImageDigest(host, "app", "v1", "", ""); err == nil {
+		t.Error("resolved a digest over plain HTTP")
+	}
+}
+
+func TestLoadRegistryConfig(t *testing.T) {
+	saved := registryConfig
+	t.Cleanup(func() { registryConfig = saved })
+	registryConfig.InsecureRegistries = nil
+	t.Setenv("INSECURE_REGISTRIES", "localhost:5000, registry.local ,")
+
+	loadRegistryConfig()
+	want := []string{"localhost:5000", "registry.local"}
+	if !slices.Equal(registryConfig.InsecureRegistries, want) {
+		t.Errorf("insecure registries = %q, want %q", registryConfig.InsecureRegistries, want)
+	}
+}
+
+func TestParseImageAddress(t *testing.T) {
+	tests := []struct {
+		address    string
+		host       string
+		repository string
+	}{
+		{"nginx", dockerHubRegistry, "library/nginx"},
+		{"bitnami/redis", dockerHubRegistry, "bitnami/redis"},
+		{"docker.io/nginx", dockerHubRegistry, "library/nginx"},
+		{"index.docker.io/bitnami/redis", dockerHubRegistry, "bitnami/redis"},
+		{"ghcr.io/team/app", "ghcr.io", "team/app"},
+		{"localhost/app", "localhost", "app"},
+		{"localhost:5000/team/app", "localhost:5000", "team/app"},
+	}
+	for _, tt := range tests {
+		host, repository := parseImageAddress(tt.address)
+		if host != tt.host || repository != tt.repository {
+			t.Errorf("parseImageAddress(%q) = %q, %q, want %q, %q", tt.address, host, repository, tt.host, tt.repository)
+		}
+	}
+}
+
+func TestNormalizeRegistryHost(t *testing.T) {
+	tests := map[string]string{
+		"https://index.docker.io/v1/": dockerHubRegistry,
+		"docker.io":                   dockerHubRegistry,
+		"http://localhost:5000":       "localhost:5000",
+		"ghcr.io":                     "ghcr.io",
+	}
+	for server, want := range tests {
+		if host := normalizeRegistryHost(server); host != want {
+			t.Errorf("normalizeRegistryHost(%q) = %q, want %q", server, host, want)
+		}
+	}
+}
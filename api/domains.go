@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// errHostTaken is returned when a host of the app is already routed by an
+// ingress of another app, possibly of another tenant.
+var errHostTaken = errors.New("host is already in use")
+
+// allocateDomain gives apps exposed without a DomainAddress a subdomain of
+// the platform base domain, <app>.<tenant>.<base>.
+func allocateDomain(req *DeploymentRequest) {
+	if !req.ExternalAccess || req.DomainAddress != "" || tenantConfig.BaseDomain == "" {
+		return
+	}
+	req.DomainAddress = fmt.Sprintf("%s.%s.%s", req.AppName, req.Tenant, tenantConfig.BaseDomain)
+}
+
+// checkHostCollisions makes sure no ingress in the cluster other than those
+// of the app itself routes one of the hosts of req.
+func checkHostCollisions(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	if !req.ExternalAccess {
+		return nil
+	}
+
+	ingressList, err := clientset.NetworkingV1().Ingresses(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("error listing ingresses: %w", err)
+	}
+
+	hosts := make(map[string]bool)
+	for _, host := range ingressHosts(req) {
+		hosts[host] = true
+	}
+	for _, ingress := range ingressList.Items {
+		if ingress.Namespace == namespace && ingress.Labels["app"] == req.AppName {
+			continue
+		}
+		for _, rule := range ingress.Spec.Rules {
+			if hosts[rule.Host] {
+				return fmt.Errorf("%w: %s", errHostTaken, rule.Host)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
+)
+
+// Every websocket message of an exec session is binary and starts with the
+// channel it belongs to, as in the channel.k8s.io protocol kubectl speaks.
+// The client writes stdin and resize messages, the latter holding the
+// terminal size as {"width": 80, "height": 24}, and the server everything
+// else and a single status message before it closes the session.
+const (
+	execStdinChannel  byte = 0
+	execStdoutChannel byte = 1
+	execStderrChannel byte = 2
+	execStatusChannel byte = 3
+	execResizeChannel byte = 4
+)
+
+// errPodNotRunning is returned for exec sessions into pods that are not
+// running, which have no container to run the command in.
+var errPodNotRunning = errors.New("pod is not running")
+
+var execUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// getAppPod returns the pod of the app named podName, or a not found error
+// for pods of other apps so a session can only reach the app it was
+// authorized for. Pods of a release of the app belong to it too.
+func getAppPod(clientset *kubernetes.Clientset, namespace string, appName string, podName string) (*corev1.Pod, error) {
+	pod, err := clientset.CoreV1().Pods(namespace).Get(context.TODO(), podName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if pod.Labels["app"] != appName && pod.Labels[releaseOfLabel] != appName {
+		return nil, apierrors.NewNotFound(corev1.Resource("pods"), podName)
+	}
+	return pod, nil
+}
+
+// execContainer is the container of pod req asks for, the app container
+// unless one is named.
+func execContainer(appName string, pod *corev1.Pod, req *ExecRequest) string {
+	if req.Container != "" {
+		return req.Container
+	}
+	for _, container := range pod.Spec.Containers {
+		if container.Name == appName {
+			return appName
+		}
+	}
+	return pod.Spec.Containers[0].Name
+}
+
+// execSession adapts a websocket connection to the streams of the remote
+// command.
+type execSession struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+	stdin   *io.PipeReader
+	resize  chan remotecommand.TerminalSize
+}
+
+func newExecSession(conn *websocket.Conn) (*execSession, *io.PipeWriter) {
+	stdin, stdinWriter := io.Pipe()
+	return &execSession{
+		conn:   conn,
+		stdin:  stdin,
+		resize: make(chan remotecommand.TerminalSize, 1),
+	}, stdinWriter
+}
+
+// readInput copies what the client writes to the command until the client
+// goes away, which ends the session.
+func (s *execSession) readInput(stdin *io.PipeWriter, cancel context.CancelFunc) {
+	defer cancel()
+	defer stdin.Close()
+	defer close(s.resize)
+
+	for {
+		_, message, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if len(message) == 0 {
+			continue
+		}
+		switch message[0] {
+		case execStdinChannel:
+			if _, err := stdin.Write(message[1:]); err != nil {
+				return
+			}
+		case execResizeChannel:
+			var size remotecommand.TerminalSize
+			if err := json.Unmarshal(message[1:], &size); err != nil {
+				continue
+			}
+			// only the latest size matters when the command lags behind
+			select {
+			case <-s.resize:
+			default:
+			}
+			s.resize <- size
+		}
+	}
+}
+
+// Next implements remotecommand.TerminalSizeQueue.
+func (s *execSession) Next() *remotecommand.TerminalSize {
+	size, ok := <-s.resize
+	if !ok {
+		return nil
+	}
+	return &size
+}
+
+func (s *execSession) write(channel byte, data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.WriteMessage(websocket.BinaryMessage, append([]byte{channel}, data...))
+}
+
+func (s *execSession) channelWriter(channel byte) io.Writer {
+	return execChannelWriter{session: s, channel: channel}
+}
+
+type execChannelWriter struct {
+	session *execSession
+	channel byte
+}
+
+func (w execChannelWriter) Write(p []byte) (int, error) {
+	if err := w.session.write(w.channel, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// execInPod runs req in container of pod through the SPDY executor of
+// client-go, relaying its streams over conn, and returns the exit code of
+// the command.
+func execInPod(ctx context.Context, config *rest.Config, clientset *kubernetes.Clientset, namespace string, pod string, container string, req *ExecRequest, conn *websocket.Conn) (int, error) {
+	request := clientset.CoreV1().RESTClient().Post().
+		Resource("pods").
+		Namespace(namespace).
+		Name(pod).
+		SubResource("exec").
+		VersionedParams(&corev1.PodExecOptions{
+			Container: container,
+			Command:   req.Command,
+			Stdin:     true,
+			Stdout:    true,
+			// a terminal merges stderr into stdout
+			Stderr: !req.TTY,
+			TTY:    req.TTY,
+		}, scheme.ParameterCodec)
+
+	executor, err := remotecommand.NewSPDYExecutor(config, "POST", request.URL())
+	if err != nil {
+		return 0, fmt.Errorf("error creating executor: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	session, stdin := newExecSession(conn)
+	go session.readInput(stdin, cancel)
+
+	options := remotecommand.StreamOptions{
+		Stdin:  session.stdin,
+		Stdout: session.channelWriter(execStdoutChannel),
+		Tty:    req.TTY,
+	}
+	if req.TTY {
+		options.TerminalSizeQueue = session
+	} else {
+		options.Stderr = session.channelWriter(execStderrChannel)
+	}
+
+	err = executor.StreamWithContext(ctx, options)
+	// unblock input the command will no longer read
+	session.stdin.Close()
+	var exitErr utilexec.CodeExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus(), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+// closeExecSession sends the final status of a session and closes it.
+func closeExecSession(conn *websocket.Conn, status ExecStatus) {
+	data, _ := json.Marshal(status)
+	// a client that stopped reading must not keep the session open
+	deadline := time.Now().Add(time.Second)
+	conn.SetWriteDeadline(deadline)
+	conn.WriteMessage(websocket.BinaryMessage, append([]byte{execStatusChannel}, data...))
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), deadline)
+	conn.Close()
+}
+
+// auditExec records an exec session in the API log and as an event on the
+// pod, so it shows up next to the pod in kubectl describe as well.
+func auditExec(clientset *kubernetes.Clientset, pod *corev1.Pod, container string, req *ExecRequest, tenant string, remoteAddr string, message string) {
+	entry := fmt.Sprintf("exec %s by tenant %s from %s into %s/%s: %s",
+		strings.Join(req.Command, " "), tenant, remoteAddr, pod.Name, container, message)
+	fmt.Println("Audit:", entry)
+
+	now := metav1.Now()
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: pod.Name + "-exec-",
+			Labels: map[string]string{
+				tenantLabel: tenant,
+			},
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Name:       pod.Name,
+			Namespace:  pod.Namespace,
+			UID:        pod.UID,
+			FieldPath:  fmt.Sprintf("spec.containers{%s}", container),
+		},
+		Reason:         "Exec",
+		Message:        entry,
+		Type:           corev1.EventTypeNormal,
+		Source:         corev1.EventSource{Component: fieldManager},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	_, err := clientset.CoreV1().Events(pod.Namespace).Create(context.TODO(), event, metav1.CreateOptions{})
+	if err != nil {
+		fmt.Printf("Error recording exec event: %v\n", err)
+	}
+}
+
+// validateExec checks that the session can start, before the connection is
+// upgraded and errors can no longer be answered with a status.
+func validateExec(pod *corev1.Pod, req *ExecRequest) error {
+	if pod.Status.Phase != corev1.PodRunning {
+		return fmt.Errorf("%w: %s is %s", errPodNotRunning, pod.Name, pod.Status.Phase)
+	}
+	if req.Container != "" && !slices.ContainsFunc(pod.Spec.Containers, func(container corev1.Container) bool {
+		return container.Name == req.Container
+	}) {
+		return apierrors.NewNotFound(corev1.Resource("containers"), req.Container)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Sources a FileMountRequest can read from: the app config map built from
+// Envs, or the app secret built from Secrets.
+const (
+	fileSourceConfig = "config"
+	fileSourceSecret = "secret"
+
+	configFilesVolumeName = "config-files"
+	secretFilesVolumeName = "secret-files"
+)
+
+// fileKeys returns the keys of pairs mounted as files from source.
+func fileKeys(files []FileMountRequest, source string) map[string]bool {
+	keys := make(map[string]bool)
+	for _, file := range files {
+		if file.Source == source {
+			keys[file.Key] = true
+		}
+	}
+	return keys
+}
+
+// buildFileMounts returns the volumes exposing the file-mounted keys of the
+// app config map and secret, and a mount per file. Every file is mounted
+// with a subPath so it can be placed next to the files of the image, e.g.
+// /etc/nginx/nginx.conf. Such files are not refreshed in place, but a changed
+// config already rolls the pods through the config hash.
+func buildFileMounts(req *DeploymentRequest) ([]corev1.Volume, []corev1.VolumeMount) {
+	var volumes []corev1.Volume
+	var mounts []corev1.VolumeMount
+
+	configItems := keyToPaths(req.Files, fileSourceConfig)
+	if len(configItems) > 0 {
+		volumes = append(volumes, corev1.Volume{
+			Name: configFilesVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				ConfigMap: &corev1.ConfigMapVolumeSource{
+					LocalObjectReference: corev1.LocalObjectReference{
+						Name: configMapName(req.AppName),
+					},
+					Items: configItems,
+				},
+			},
+		})
+	}
+
+	secretItems := keyToPaths(req.Files, fileSourceSecret)
+	if len(secretItems) > 0 {
+		volumes = append(volumes, corev1.Volume{
+			Name: secretFilesVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{
+					SecretName: secretName(req.AppName),
+					Items:      secretItems,
+				},
+			},
+		})
+	}
+
+	for _, file := range req.Files {
+		volumeName := configFilesVolumeName
+		if file.Source == fileSourceSecret {
+			volumeName = secretFilesVolumeName
+		}
+		mounts = append(mounts, corev1.VolumeMount{
+			Name:      volumeName,
+			MountPath: file.MountPath,
+			SubPath:   file.Key,
+			ReadOnly:  true,
+		})
+	}
+
+	return volumes, mounts
+}
+
+// keyToPaths projects every key of source mounted as a file, once, to a
+// path named after the key.
+func keyToPaths(files []FileMountRequest, source string) []corev1.KeyToPath {
+	modes := make(map[string]*int32)
+	for _, file := range files {
+		if file.Source != source {
+			continue
+		}
+		if _, ok := modes[file.Key]; !ok || file.Mode != nil {
+			modes[file.Key] = file.Mode
+		}
+	}
+
+	keys := make([]string, 0, len(modes))
+	for key := range modes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	items := make([]corev1.KeyToPath, 0, len(keys))
+	for _, key := range keys {
+		items = append(items, corev1.KeyToPath{
+			Key:  key,
+			Path: key,
+			Mode: modes[key],
+		})
+	}
+	return items
+}
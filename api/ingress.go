@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Annotations of the ingress-nginx controller the ingress options translate
+// into. Only these vetted options are exposed, never raw annotations or
+// configuration snippets.
+const (
+	nginxProxyBodySizeAnnotation        = "nginx.ingress.kubernetes.io/proxy-body-size"
+	nginxProxyConnectTimeoutAnnotation  = "nginx.ingress.kubernetes.io/proxy-connect-timeout"
+	nginxProxyReadTimeoutAnnotation     = "nginx.ingress.kubernetes.io/proxy-read-timeout"
+	nginxProxySendTimeoutAnnotation     = "nginx.ingress.kubernetes.io/proxy-send-timeout"
+	nginxRewriteTargetAnnotation        = "nginx.ingress.kubernetes.io/rewrite-target"
+	nginxUseRegexAnnotation             = "nginx.ingress.kubernetes.io/use-regex"
+	nginxEnableCORSAnnotation           = "nginx.ingress.kubernetes.io/enable-cors"
+	nginxCORSAllowOriginAnnotation      = "nginx.ingress.kubernetes.io/cors-allow-origin"
+	nginxCORSAllowMethodsAnnotation     = "nginx.ingress.kubernetes.io/cors-allow-methods"
+	nginxCORSAllowHeadersAnnotation     = "nginx.ingress.kubernetes.io/cors-allow-headers"
+	nginxCORSAllowCredentialsAnnotation = "nginx.ingress.kubernetes.io/cors-allow-credentials"
+	nginxCORSMaxAgeAnnotation           = "nginx.ingress.kubernetes.io/cors-max-age"
+	nginxAuthTypeAnnotation             = "nginx.ingress.kubernetes.io/auth-type"
+	nginxAuthSecretAnnotation           = "nginx.ingress.kubernetes.io/auth-secret"
+	nginxAuthRealmAnnotation            = "nginx.ingress.kubernetes.io/auth-realm"
+	nginxSourceRangeAnnotation          = "nginx.ingress.kubernetes.io/whitelist-source-range"
+)
+
+// ownedIngressAnnotations are the annotations the API sets on ingresses. They
+// are removed again once a request no longer asks for them, while other
+// annotations are left alone.
+var ownedIngressAnnotations = []string{
+	certManagerIssuerAnnotation,
+	certManagerClusterIssuerAnnotation,
+	nginxProxyBodySizeAnnotation,
+	nginxProxyConnectTimeoutAnnotation,
+	nginxProxyReadTimeoutAnnotation,
+	nginxProxySendTimeoutAnnotation,
+	nginxRewriteTargetAnnotation,
+	nginxUseRegexAnnotation,
+	nginxEnableCORSAnnotation,
+	nginxCORSAllowOriginAnnotation,
+	nginxCORSAllowMethodsAnnotation,
+	nginxCORSAllowHeadersAnnotation,
+	nginxCORSAllowCredentialsAnnotation,
+	nginxCORSMaxAgeAnnotation,
+	nginxAuthTypeAnnotation,
+	nginxAuthSecretAnnotation,
+	nginxAuthRealmAnnotation,
+	nginxSourceRangeAnnotation,
+}
+
+func basicAuthSecretName(appName string) string {
+	return appName + "-basic-auth"
+}
+
+// ingressHosts returns DomainAddress followed by the additional hosts of
+// req, all routed the same way.
+func ingressHosts(req *DeploymentRequest) []string {
+	hosts := []string{req.DomainAddress}
+	if req.Ingress != nil {
+		hosts = append(hosts, req.Ingress.Hosts...)
+	}
+	return hosts
+}
+
+// ingressPaths returns the paths of req, or a single prefix route of / to
+// the primary port when none are given.
+func ingressPaths(req *DeploymentRequest) []networkingv1.HTTPIngressPath {
+	paths := []IngressPathRequest{{Path: "/"}}
+	if req.Ingress != nil && len(req.Ingress.Paths) > 0 {
+		paths = req.Ingress.Paths
+	}
+
+	var result []networkingv1.HTTPIngressPath
+	for _, path := range paths {
+		pathType := networkingv1.PathType(path.PathType)
+		if pathType == "" {
+			pathType = networkingv1.PathTypePrefix
+		}
+		port := path.Port
+		if port == 0 {
+			port = primaryPort(req).Port
+		}
+		result = append(result, networkingv1.HTTPIngressPath{
+			Path:     path.Path,
+			PathType: &pathType,
+			Backend: networkingv1.IngressBackend{
+				Service: &networkingv1.IngressServiceBackend{
+					Name: serviceName(req.AppName),
+					Port: networkingv1.ServiceBackendPort{
+						Number: port,
+					},
+				},
+			},
+		})
+	}
+	return result
+}
+
+// isRegexPath reports whether path is a regular expression rather than a
+// plain URL path.
+func isRegexPath(path IngressPathRequest) bool {
+	return !plainPathRegexp.MatchString(path.Path)
+}
+
+func buildIngressRules(req *DeploymentRequest) []networkingv1.IngressRule {
+	var rules []networkingv1.IngressRule
+	for _, host := range ingressHosts(req) {
+		rules = append(rules, networkingv1.IngressRule{
+			Host: host,
+			IngressRuleValue: networkingv1.IngressRuleValue{
+				HTTP: &networkingv1.HTTPIngressRuleValue{
+					Paths: ingressPaths(req),
+				},
+			},
+		})
+	}
+	return rules
+}
+
+// setIngressOptions sets the ingress class of ingress and translates the
+// options of req into controller annotations.
+func setIngressOptions(ingress *networkingv1.Ingress, req *DeploymentRequest) {
+	if req.Ingress == nil {
+		return
+	}
+	if req.Ingress.ClassName != "" {
+		ingress.Spec.IngressClassName = &req.Ingress.ClassName
+	}
+
+	options := &req.Ingress.Options
+	annotations := make(map[string]string)
+	if options.ProxyBodySize != "" {
+		annotations[nginxProxyBodySizeAnnotation] = options.ProxyBodySize
+	}
+	timeouts := []struct {
+		annotation string
+		seconds    int32
+	}{
+		{nginxProxyConnectTimeoutAnnotation, options.ProxyConnectTimeout},
+		{nginxProxyReadTimeoutAnnotation, options.ProxyReadTimeout},
+		{nginxProxySendTimeoutAnnotation, options.ProxySendTimeout},
+	}
+	for _, timeout := range timeouts {
+		if timeout.seconds > 0 {
+			annotations[timeout.annotation] = strconv.Itoa(int(timeout.seconds))
+		}
+	}
+	if options.RewriteTarget != "" {
+		annotations[nginxRewriteTargetAnnotation] = options.RewriteTarget
+	}
+	// capture groups like $1 only work with regex paths, and the controller
+	// matches regex paths literally unless told otherwise
+	if strings.Contains(options.RewriteTarget, "$") || slices.ContainsFunc(req.Ingress.Paths, isRegexPath) {
+		annotations[nginxUseRegexAnnotation] = "true"
+	}
+	if cors := options.CORS; cors != nil {
+		annotations[nginxEnableCORSAnnotation] = "true"
+		if len(cors.AllowOrigins) > 0 {
+			annotations[nginxCORSAllowOriginAnnotation] = strings.Join(cors.AllowOrigins, ", ")
+		}
+		if len(cors.AllowMethods) > 0 {
+			annotations[nginxCORSAllowMethodsAnnotation] = strings.Join(cors.AllowMethods, ", ")
+		}
+		if len(cors.AllowHeaders) > 0 {
+			annotations[nginxCORSAllowHeadersAnnotation] = strings.Join(cors.AllowHeaders, ", ")
+		}
+		annotations[nginxCORSAllowCredentialsAnnotation] = strconv.FormatBool(cors.AllowCredentials)
+		if cors.MaxAge > 0 {
+			annotations[nginxCORSMaxAgeAnnotation] = strconv.Itoa(int(cors.MaxAge))
+		}
+	}
+	if len(options.BasicAuth) > 0 {
+		annotations[nginxAuthTypeAnnotation] = "basic"
+		annotations[nginxAuthSecretAnnotation] = basicAuthSecretName(req.AppName)
+		annotations[nginxAuthRealmAnnotation] = "Authentication Required"
+	}
+	if len(options.AllowedSourceRanges) > 0 {
+		annotations[nginxSourceRangeAnnotation] = strings.Join(options.AllowedSourceRanges, ",")
+	}
+
+	for key, value := range annotations {
+		metav1.SetMetaDataAnnotation(&ingress.ObjectMeta, key, value)
+	}
+}
+
+func usesBasicAuth(req *DeploymentRequest) bool {
+	return req.ExternalAccess && req.Ingress != nil && len(req.Ingress.Options.BasicAuth) > 0
+}
+
+// buildBasicAuthSecret builds the htpasswd file the controller checks basic
+// auth credentials against. Only bcrypt hashes of the passwords are stored.
+// bcrypt salts every hash anew, so the hashes in live, the current secret if
+// there is one, are kept for the passwords they still match, leaving the
+// secret unchanged when the credentials are.
+func buildBasicAuthSecret(req *DeploymentRequest, live *corev1.Secret) (*corev1.Secret, error) {
+	var liveHashes map[string]string
+	if live != nil {
+		liveHashes = parseHtpasswd(live.Data["auth"])
+	}
+
+	var htpasswd strings.Builder
+	for _, user := range req.Ingress.Options.BasicAuth {
+		hash, ok := liveHashes[user.Username]
+		if !ok || bcrypt.CompareHashAndPassword([]byte(hash), []byte(user.Password)) != nil {
+			generated, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+			if err != nil {
+				return nil, fmt.Errorf("error hashing password of %s: %v", user.Username, err)
+			}
+			hash = string(generated)
+		}
+		fmt.Fprintf(&htpasswd, "%s:%s\n", user.Username, hash)
+	}
+
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   basicAuthSecretName(req.AppName),
+			Labels: appLabels(req),
+		},
+		Data: map[string][]byte{
+			"auth": []byte(htpasswd.String()),
+		},
+	}, nil
+}
+
+// parseHtpasswd returns the password hashes of an htpasswd file by user.
+func parseHtpasswd(data []byte) map[string]string {
+	hashes := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		if username, hash, ok := strings.Cut(line, ":"); ok {
+			hashes[username] = hash
+		}
+	}
+	return hashes
+}
+
+func createBasicAuthSecret(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	secret, err := buildBasicAuthSecret(req, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Creating basic auth secret...")
+	_, err = clientset.CoreV1().Secrets(namespace).Create(context.TODO(), secret, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// reconcileBasicAuthSecret rewrites the basic auth credentials of the app,
+// deleting them when basic auth is no longer requested.
+func reconcileBasicAuthSecret(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	secretsClient := clientset.CoreV1().Secrets(namespace)
+	secret, err := secretsClient.Get(context.TODO(), basicAuthSecretName(req.AppName), metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error fetching basic auth secret: %w", err)
+	}
+	exists := err == nil
+
+	if !usesBasicAuth(req) {
+		if !exists {
+			return nil
+		}
+		fmt.Println("Deleting basic auth secret...")
+		err = secretsClient.Delete(context.TODO(), secret.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("error deleting basic auth secret: %w", err)
+		}
+		return nil
+	}
+
+	if !exists {
+		return createBasicAuthSecret(clientset, namespace, req)
+	}
+
+	desired, err := buildBasicAuthSecret(req, secret)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(secret.Data["auth"], desired.Data["auth"]) {
+		return nil
+	}
+	secret.Data = desired.Data
+
+	fmt.Println("Updating basic auth secret...")
+	_, err = secretsClient.Update(context.TODO(), secret, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("error updating basic auth secret: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestIngressUseRegex(t *testing.T) {
+	tests := []struct {
+		name    string
+		ingress IngressRequest
+		want    bool
+	}{
+		{
+			name:    "plain paths",
+			ingress: IngressRequest{Paths: []IngressPathRequest{{Path: "/api"}}},
+		},
+		{
+			name: "regex path without rewrite",
+			ingress: IngressRequest{Paths: []IngressPathRequest{
+				{Path: "/api"},
+				{Path: "/v[0-9]+/users", PathType: "ImplementationSpecific"},
+			}},
+			want: true,
+		},
+		{
+			name: "rewrite with capture group",
+			ingress: IngressRequest{
+				Paths:   []IngressPathRequest{{Path: "/api(/|$)(.*)", PathType: "ImplementationSpecific"}},
+				Options: IngressOptions{RewriteTarget: "/$2"},
+			},
+			want: true,
+		},
+		{
+			name: "plain rewrite",
+			ingress: IngressRequest{
+				Paths:   []IngressPathRequest{{Path: "/api"}},
+				Options: IngressOptions{RewriteTarget: "/"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &DeploymentRequest{
+				AppName:        "web",
+				Tenant:         "team",
+				ServicePort:    80,
+				ExternalAccess: true,
+				Ingress:        &tt.ingress,
+			}
+			ingress := buildIngress(req)
+			if got := ingress.Annotations[nginxUseRegexAnnotation] == "true"; got != tt.want {
+				t.Errorf("use-regex = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	jobLabel     = "kaasapi/job"
+	cronJobLabel = "kaasapi/cronjob"
+
+	// jobNameLabel is set on the pods of a job by the job controller.
+	jobNameLabel = "job-name"
+
+	// instantiateAnnotation marks jobs started by hand rather than on the
+	// schedule of their cron job, as kubectl create job --from does.
+	instantiateAnnotation = "cronjob.kubernetes.io/instantiate"
+
+	// maxCronJobNameLength leaves room for the suffix of the names of the
+	// jobs a cron job starts, whose pods are labelled with them.
+	maxCronJobNameLength = 52
+)
+
+// jobSecretName is the secret holding the secrets of the job name. App
+// names cannot contain dots, so no secret derived from an app can take it.
+func jobSecretName(name string) string {
+	return "job-secret." + name
+}
+
+// cronJobSecretName is the secret shared by the runs of the cron job name.
+// Jobs and cron jobs may have the same name, so their secrets are kept apart.
+func cronJobSecretName(name string) string {
+	return "cronjob-secret." + name
+}
+
+func jobLabels(req *JobRequest) map[string]string {
+	return map[string]string{
+		jobLabel:    req.Name,
+		tenantLabel: req.Tenant,
+	}
+}
+
+func cronJobLabels(req *CronJobRequest) map[string]string {
+	labels := jobLabels(&req.JobRequest)
+	labels[cronJobLabel] = req.Name
+	return labels
+}
+
+// buildJobSpec builds the spec of the jobs run for req. Failed pods are not
+// restarted in place but replaced, up to the backoff limit, so their logs
+// stay available.
+func buildJobSpec(req *JobRequest, labels map[string]string, secret string) batchv1.JobSpec {
+	var env []corev1.EnvVar
+	for _, kv := range req.Envs {
+		env = append(env, corev1.EnvVar{Name: kv.Key, Value: kv.Value})
+	}
+	var envFrom []corev1.EnvFromSource
+	if len(req.Secrets) > 0 {
+		envFrom = append(envFrom, corev1.EnvFromSource{
+			SecretRef: &corev1.SecretEnvSource{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: secret,
+				},
+			},
+		})
+	}
+
+	return batchv1.JobSpec{
+		BackoffLimit:          req.BackoffLimit,
+		ActiveDeadlineSeconds: req.ActiveDeadlineSeconds,
+		Template: corev1.PodTemplateSpec{
+			ObjectMeta: metav1.ObjectMeta{
+				Labels: labels,
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{
+						Name:      req.Name,
+						Image:     fmt.Sprintf("%s:%s", req.ImageAddress, req.ImageTag),
+						Command:   req.Command,
+						Args:      req.Args,
+						Env:       env,
+						EnvFrom:   envFrom,
+						Resources: resourceRequirements(&req.Resources),
+					},
+				},
+				RestartPolicy:    corev1.RestartPolicyNever,
+				ImagePullSecrets: buildImagePullSecrets(req.ImagePullSecrets),
+			},
+		},
+	}
+}
+
+func buildJob(req *JobRequest) *batchv1.Job {
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   req.Name,
+			Labels: jobLabels(req),
+		},
+		Spec: buildJobSpec(req, jobLabels(req), jobSecretName(req.Name)),
+	}
+}
+
+func buildCronJob(req *CronJobRequest) *batchv1.CronJob {
+	cronJob := &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   req.Name,
+			Labels: cronJobLabels(req),
+		},
+		Spec: batchv1.CronJobSpec{
+			Schedule:                   req.Schedule,
+			ConcurrencyPolicy:          batchv1.ConcurrencyPolicy(req.ConcurrencyPolicy),
+			Suspend:                    &req.Suspend,
+			StartingDeadlineSeconds:    req.StartingDeadlineSeconds,
+			SuccessfulJobsHistoryLimit: req.SuccessfulJobsHistoryLimit,
+			FailedJobsHistoryLimit:     req.FailedJobsHistoryLimit,
+			JobTemplate: batchv1.JobTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: cronJobLabels(req),
+				},
+				Spec: buildJobSpec(&req.JobRequest, cronJobLabels(req), cronJobSecretName(req.Name)),
+			},
+		},
+	}
+	if cronJob.Spec.ConcurrencyPolicy == "" {
+		cronJob.Spec.ConcurrencyPolicy = batchv1.AllowConcurrent
+	}
+	if req.TimeZone != "" {
+		cronJob.Spec.TimeZone = &req.TimeZone
+	}
+	return cronJob
+}
+
+func buildJobSecret(req *JobRequest, name string, labels map[string]string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: labels,
+		},
+		StringData: keyValueMap(req.Secrets),
+	}
+}
+
+// createJob starts the job described by req. Its secret is created first
+// and handed over to the job once it exists, so it is garbage collected
+// together with the job.
+func createJob(clientset *kubernetes.Clientset, namespace string, req *JobRequest) error {
+	tx := newTransaction(clientset, namespace)
+
+	if len(req.Secrets) > 0 {
+		err := tx.do("secret", jobSecretName(req.Name), func() error {
+			fmt.Println("Creating job secret...")
+			_, err := clientset.CoreV1().Secrets(namespace).Create(context.TODO(), buildJobSecret(req, jobSecretName(req.Name), jobLabels(req)), metav1.CreateOptions{})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var job *batchv1.Job
+	err := tx.do("job", req.Name, func() error {
+		fmt.Println("Creating job...")
+		var err error
+		job, err = clientset.BatchV1().Jobs(namespace).Create(context.TODO(), buildJob(req), metav1.CreateOptions{})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(req.Secrets) == 0 {
+		return nil
+	}
+	err = setSecretOwner(clientset, namespace, jobSecretName(req.Name), batchv1.SchemeGroupVersion.WithKind("Job"), &job.ObjectMeta)
+	if err != nil {
+		// an orphaned secret would never be garbage collected
+		return tx.fail("secret", jobSecretName(req.Name), err)
+	}
+
+	return nil
+}
+
+// createCronJob creates the cron job described by req, which owns the
+// secret shared by all of its runs.
+func createCronJob(clientset *kubernetes.Clientset, namespace string, req *CronJobRequest) error {
+	tx := newTransaction(clientset, namespace)
+
+	if len(req.Secrets) > 0 {
+		err := tx.do("secret", cronJobSecretName(req.Name), func() error {
+			fmt.Println("Creating cron job secret...")
+			_, err := clientset.CoreV1().Secrets(namespace).Create(context.TODO(), buildJobSecret(&req.JobRequest, cronJobSecretName(req.Name), cronJobLabels(req)), metav1.CreateOptions{})
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	var cronJob *batchv1.CronJob
+	err := tx.do("cronjob", req.Name, func() error {
+		fmt.Println("Creating cron job...")
+		var err error
+		cronJob, err = clientset.BatchV1().CronJobs(namespace).Create(context.TODO(), buildCronJob(req), metav1.CreateOptions{})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(req.Secrets) == 0 {
+		return nil
+	}
+	err = setSecretOwner(clientset, namespace, cronJobSecretName(req.Name), batchv1.SchemeGroupVersion.WithKind("CronJob"), &cronJob.ObjectMeta)
+	if err != nil {
+		return tx.fail("secret", cronJobSecretName(req.Name), err)
+	}
+
+	return nil
+}
+
+func setSecretOwner(clientset *kubernetes.Clientset, namespace string, name string, ownerKind schema.GroupVersionKind, owner *metav1.ObjectMeta) error {
+	secretsClient := clientset.CoreV1().Secrets(namespace)
+	secret, err := secretsClient.Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error fetching secret: %w", err)
+	}
+	secret.OwnerReferences = []metav1.OwnerReference{*metav1.NewControllerRef(owner, ownerKind)}
+
+	_, err = secretsClient.Update(context.TODO(), secret, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("error updating secret: %w", err)
+	}
+
+	return nil
+}
+
+// triggerCronJob starts a run of the cron job name right away, outside of
+// its schedule.
+func triggerCronJob(clientset *kubernetes.Clientset, namespace string, tenant string, name string) (*JobInfo, error) {
+	cronJob, err := getOwnedCronJob(clientset, namespace, tenant, name)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: cronJob.Name + "-",
+			Labels:       cronJob.Spec.JobTemplate.Labels,
+			Annotations: map[string]string{
+				instantiateAnnotation: "manual",
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(cronJob, batchv1.SchemeGroupVersion.WithKind("CronJob")),
+			},
+		},
+		Spec: cronJob.Spec.JobTemplate.Spec,
+	}
+
+	fmt.Println("Triggering cron job...")
+	job, err = clientset.BatchV1().Jobs(namespace).Create(context.TODO(), job, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error creating job: %w", err)
+	}
+
+	info := jobInfo(job)
+	return &info, nil
+}
+
+// getOwnedJob returns the job name if it was created through the API for
+// tenant, and a not found error otherwise.
+func getOwnedJob(clientset *kubernetes.Clientset, namespace string, tenant string, name string) (*batchv1.Job, error) {
+	job, err := clientset.BatchV1().Jobs(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if job.Labels[jobLabel] == "" || job.Labels[tenantLabel] != tenant {
+		return nil, apierrors.NewNotFound(batchv1.Resource("jobs"), name)
+	}
+	return job, nil
+}
+
+func getOwnedCronJob(clientset *kubernetes.Clientset, namespace string, tenant string, name string) (*batchv1.CronJob, error) {
+	cronJob, err := clientset.BatchV1().CronJobs(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if cronJob.Labels[cronJobLabel] == "" || cronJob.Labels[tenantLabel] != tenant {
+		return nil, apierrors.NewNotFound(batchv1.Resource("cronjobs"), name)
+	}
+	return cronJob, nil
+}
+
+// jobInfo describes job without its pods.
+func jobInfo(job *batchv1.Job) JobInfo {
+	info := JobInfo{
+		Name:           job.Name,
+		CronJob:        job.Labels[cronJobLabel],
+		Status:         jobStatus(job),
+		Active:         job.Status.Active,
+		Succeeded:      job.Status.Succeeded,
+		Failed:         job.Status.Failed,
+		StartTime:      job.Status.StartTime,
+		CompletionTime: job.Status.CompletionTime,
+	}
+	if containers := job.Spec.Template.Spec.Containers; len(containers) > 0 {
+		info.Image = containers[0].Image
+	}
+	return info
+}
+
+func jobStatus(job *batchv1.Job) string {
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobComplete:
+			return "Succeeded"
+		case batchv1.JobFailed:
+			return "Failed"
+		}
+	}
+	if job.Status.Active > 0 {
+		return "Running"
+	}
+	return "Pending"
+}
+
+// listJobs lists the jobs of tenant, selected by selector, which are either
+// started directly or by one of its cron jobs.
+func listJobs(clientset *kubernetes.Clientset, namespace string, tenant string, selector string) ([]JobInfo, error) {
+	jobList, err := clientset.BatchV1().Jobs(namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s,%s", tenantLabel, tenant, selector),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing jobs: %v", err)
+	}
+
+	jobs := make([]JobInfo, 0, len(jobList.Items))
+	for _, job := range jobList.Items {
+		jobs = append(jobs, jobInfo(&job))
+	}
+	return jobs, nil
+}
+
+func getJobInfo(clientset *kubernetes.Clientset, namespace string, tenant string, name string) (*JobInfo, error) {
+	job, err := getOwnedJob(clientset, namespace, tenant, name)
+	if err != nil {
+		return nil, err
+	}
+
+	info := jobInfo(job)
+	info.PodStatuses, err = listPodStatuses(clientset, namespace, fmt.Sprintf("%s=%s", jobNameLabel, job.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+func cronJobInfo(cronJob *batchv1.CronJob) CronJobInfo {
+	info := CronJobInfo{
+		Name:               cronJob.Name,
+		Schedule:           cronJob.Spec.Schedule,
+		ConcurrencyPolicy:  string(cronJob.Spec.ConcurrencyPolicy),
+		LastScheduleTime:   cronJob.Status.LastScheduleTime,
+		LastSuccessfulTime: cronJob.Status.LastSuccessfulTime,
+	}
+	if cronJob.Spec.TimeZone != nil {
+		info.TimeZone = *cronJob.Spec.TimeZone
+	}
+	if cronJob.Spec.Suspend != nil {
+		info.Suspend = *cronJob.Spec.Suspend
+	}
+	if containers := cronJob.Spec.JobTemplate.Spec.Template.Spec.Containers; len(containers) > 0 {
+		info.Image = containers[0].Image
+	}
+	return info
+}
+
+func listCronJobs(clientset *kubernetes.Clientset, namespace string, tenant string) ([]CronJobInfo, error) {
+	cronJobList, err := clientset.BatchV1().CronJobs(namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s,%s", tenantLabel, tenant, cronJobLabel),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing cron jobs: %v", err)
+	}
+
+	cronJobs := make([]CronJobInfo, 0, len(cronJobList.Items))
+	for _, cronJob := range cronJobList.Items {
+		cronJobs = append(cronJobs, cronJobInfo(&cronJob))
+	}
+	return cronJobs, nil
+}
+
+// getCronJobInfo describes the cron job name together with the runs its
+// history limits have kept.
+func getCronJobInfo(clientset *kubernetes.Clientset, namespace string, tenant string, name string) (*CronJobInfo, error) {
+	cronJob, err := getOwnedCronJob(clientset, namespace, tenant, name)
+	if err != nil {
+		return nil, err
+	}
+
+	info := cronJobInfo(cronJob)
+	info.Runs, err = listJobs(clientset, namespace, tenant, fmt.Sprintf("%s=%s", cronJobLabel, name))
+	if err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// deleteJob deletes the job name, its pods and its secret. Deleting a cron
+// job takes its runs with it.
+func deleteJob(clientset *kubernetes.Clientset, namespace string, tenant string, name string) error {
+	job, err := getOwnedJob(clientset, namespace, tenant, name)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Deleting job...")
+	return deleteObject(clientset, namespace, "job", job.Name)
+}
+
+func deleteCronJob(clientset *kubernetes.Clientset, namespace string, tenant string, name string) error {
+	cronJob, err := getOwnedCronJob(clientset, namespace, tenant, name)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Deleting cron job...")
+	return deleteObject(clientset, namespace, "cronjob", cronJob.Name)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// logsPodResync is how often followed logs look for pods started since, such
+// as the new pods of a rollout.
+const logsPodResync = 5 * time.Second
+
+// podLogOptions maps req onto the log options of the app pods. Since is
+// checked by validateLogRequest.
+func podLogOptions(container string, req *LogRequest) *corev1.PodLogOptions {
+	opts := &corev1.PodLogOptions{
+		Container: container,
+		Follow:    req.Follow,
+		TailLines: req.Tail,
+	}
+	if req.Since != "" {
+		since, _ := time.ParseDuration(req.Since)
+		seconds := int64(since.Seconds())
+		opts.SinceSeconds = &seconds
+	}
+	return opts
+}
+
+// logContainer is the container whose logs req asks for, the app container
+// unless one is named.
+func logContainer(appName string, template *corev1.PodTemplateSpec, req *LogRequest) string {
+	if req.Container != "" {
+		return req.Container
+	}
+	if container := appContainer(appName, template); container != nil {
+		return container.Name
+	}
+	return appName
+}
+
+// streamLogs writes the logs of every pod of the app to emit, one line at a
+// time. Without follow the pods are read one after the other. With follow
+// their logs are interleaved as they are written until ctx is done, pods
+// started later are followed from their first line and restarted containers
+// from where their previous stream ended.
+func streamLogs(ctx context.Context, clientset *kubernetes.Clientset, namespace string, appName string, opts *corev1.PodLogOptions, emit func(pod string, line string) error) error {
+	if !opts.Follow {
+		pods, err := listAppPods(ctx, clientset, namespace, appName)
+		if err != nil {
+			return err
+		}
+		for _, pod := range pods {
+			var emitErr error
+			err := readPodLogs(ctx, clientset, namespace, pod, opts, func(line string) error {
+				emitErr = emit(pod, line)
+				return emitErr
+			})
+			if emitErr != nil {
+				return emitErr
+			}
+			// pods whose container has not started have no logs to read yet
+			if err != nil {
+				fmt.Printf("Skipping logs of app %s: %v\n", appName, err)
+			}
+		}
+		return nil
+	}
+
+	type logLine struct {
+		pod  string
+		line string
+	}
+	type streamEnd struct {
+		pod   string
+		since metav1.Time
+	}
+	lines := make(chan logLine)
+	ended := make(chan streamEnd)
+	followed := make(map[string]bool)
+	resume := make(map[string]metav1.Time)
+
+	follow := func(pod string, opts *corev1.PodLogOptions) {
+		followed[pod] = true
+		go func() {
+			attempted := metav1.Now()
+			read := false
+			err := readPodLogs(ctx, clientset, namespace, pod, opts, func(line string) error {
+				read = true
+				select {
+				case lines <- logLine{pod: pod, line: line}:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+			// streams end when the container exits and fail while it has not
+			// started, either way the pod is followed again on the next
+			// resync from where it was left
+			end := streamEnd{pod: pod, since: metav1.Now()}
+			if err != nil && !read {
+				end.since = attempted
+			}
+			select {
+			case ended <- end:
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	pods, err := listAppPods(ctx, clientset, namespace, appName)
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		follow(pod, opts)
+	}
+
+	ticker := time.NewTicker(logsPodResync)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case l := <-lines:
+			if err := emit(l.pod, l.line); err != nil {
+				return err
+			}
+		case end := <-ended:
+			delete(followed, end.pod)
+			resume[end.pod] = end.since
+		case <-ticker.C:
+			pods, err := listAppPods(ctx, clientset, namespace, appName)
+			if err != nil {
+				continue
+			}
+			for _, pod := range pods {
+				if followed[pod] {
+					continue
+				}
+				// pods found later are read from their start, since and tail
+				// only limit what was logged before the request
+				laterOpts := &corev1.PodLogOptions{
+					Container: opts.Container,
+					Follow:    true,
+				}
+				if since, ok := resume[pod]; ok {
+					laterOpts.SinceTime = &since
+				}
+				follow(pod, laterOpts)
+			}
+		}
+	}
+}
+
+// listAppPods returns the names of the pods of the app and of a release of
+// it in progress, sorted so their logs are read in a stable order.
+func listAppPods(ctx context.Context, clientset *kubernetes.Clientset, namespace string, appName string) ([]string, error) {
+	var pods []string
+	for _, set := range []labels.Set{{"app": appName}, {releaseOfLabel: appName}} {
+		podList, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: labels.SelectorFromSet(set).String(),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error listing pods: %v", err)
+		}
+		for _, pod := range podList.Items {
+			if !slices.Contains(pods, pod.Name) {
+				pods = append(pods, pod.Name)
+			}
+		}
+	}
+	sort.Strings(pods)
+	return pods, nil
+}
+
+func readPodLogs(ctx context.Context, clientset *kubernetes.Clientset, namespace string, pod string, opts *corev1.PodLogOptions, emit func(line string) error) error {
+	stream, err := clientset.CoreV1().Pods(namespace).GetLogs(pod, opts).Stream(ctx)
+	if err != nil {
+		return fmt.Errorf("error streaming logs of %s: %v", pod, err)
+	}
+	defer stream.Close()
+
+	reader := bufio.NewReader(stream)
+	for {
+		line, err := reader.ReadString('\n')
+		if len(line) > 0 {
+			if err := emit(strings.TrimRight(line, "\r\n")); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading logs of %s: %v", pod, err)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -11,6 +13,8 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sethvargo/go-password/password"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
@@ -67,6 +71,36 @@ func requestMetricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+// creationError renders the failed creation of what, listing the failed
+// step and the objects that were rolled back when err is a *TransactionError.
+func creationError(c echo.Context, what string, err error) error {
+	status := http.StatusInternalServerError
+	if apierrors.IsAlreadyExists(err) || errors.Is(err, errHostTaken) {
+		status = http.StatusConflict
+	}
+
+	var txErr *TransactionError
+	if errors.As(err, &txErr) {
+		return c.JSON(status, txErr)
+	}
+	return c.String(status, fmt.Sprintf("Error creating %s: %v", what, err))
+}
+
+// digestError reports a tag that could not be resolved to a digest, either
+// because the registry does not have it or because it could not be reached.
+func digestError(c echo.Context, err error) error {
+	status := http.StatusBadGateway
+	if errors.Is(err, errImageNotFound) {
+		status = http.StatusUnprocessableEntity
+	}
+	return c.String(status, fmt.Sprintf("Error pinning image digest: %v", err))
+}
+
+// validationError renders the field errors of an invalid request.
+func validationError(c echo.Context, err *ValidationError) error {
+	return c.JSON(http.StatusUnprocessableEntity, err)
+}
+
 func main() {
 	// // Use external access config
 	// var kubeconfig *string
@@ -91,6 +125,9 @@ func main() {
 	if err != nil {
 		panic(err.Error())
 	}
+	// Record every write of the API under the same field manager that
+	// server-side apply uses.
+	config.UserAgent = fieldManager
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		panic(err.Error())
@@ -103,9 +140,27 @@ func main() {
 	e.Use(middleware.Recover())
 	e.Use(requestMetricsMiddleware)
 
-	e.GET("/deployments/:appName", func(c echo.Context) error {
+	authConfig, err := loadAuthConfig()
+	if err != nil {
+		panic(err.Error())
+	}
+
+	// every app of a tenant lives in the tenant namespace, and callers only
+	// ever see the apps of their own tenant
+	loadTenantConfig()
+	loadRegistryConfig()
+	if err := loadResourcePresets(); err != nil {
+		panic(err.Error())
+	}
+	deployments := e.Group("/deployments",
+		authMiddleware(authConfig),
+		tenantMiddleware(clientset),
+		ownershipMiddleware(clientset),
+	)
+
+	deployments.GET("/:appName", func(c echo.Context) error {
 		appName := c.Param("appName")
-		deploymentInfo, err := getDeploymentInfo(clientset, appName)
+		deploymentInfo, err := getDeploymentInfo(clientset, tenantNamespace(c), appName)
 		if err != nil {
 			return c.String(http.StatusNotFound, fmt.Sprintf("Error fetching deployment: %v", err))
 		}
@@ -113,8 +168,8 @@ func main() {
 		return c.JSON(http.StatusOK, deploymentInfo)
 	})
 
-	e.GET("/deployments", func(c echo.Context) error {
-		deploymentsInfo, err := getAllDeploymentsInfo(clientset)
+	deployments.GET("", func(c echo.Context) error {
+		deploymentsInfo, err := getAllDeploymentsInfo(clientset, tenantNamespace(c), tenantOf(c))
 		if err != nil {
 			return c.String(http.StatusInternalServerError, fmt.Sprintf("Error fetching deployments: %v", err))
 		}
@@ -122,59 +177,346 @@ func main() {
 		return c.JSON(http.StatusOK, deploymentsInfo)
 	})
 
-	e.POST("/deployments", func(c echo.Context) error {
+	deployments.POST("", func(c echo.Context) error {
 		req := new(DeploymentRequest)
 		if err := c.Bind(req); err != nil {
 			return c.String(http.StatusBadRequest, fmt.Sprintf("Error parsing request body: %v", err))
 		}
-		err := createDeployment(clientset, req)
+		req.Tenant = tenantOf(c)
+		applyRequestDefaults(req)
+		if err := validateDeploymentRequest(req); err != nil {
+			return validationError(c, err)
+		}
+		if err := validateImagePullSecrets(clientset, tenantNamespace(c), req.ImagePullSecrets); err != nil {
+			return validationError(c, err)
+		}
+		if err := pinImageDigest(clientset, tenantNamespace(c), req); err != nil {
+			return digestError(c, err)
+		}
+
+		// In apply mode the request is declarative and can be resubmitted
+		// to converge the app, instead of failing when it already exists.
+		if c.QueryParam("mode") == "apply" {
+			err := applyDeployment(clientset, tenantNamespace(c), req)
+			if errors.Is(err, errHostTaken) || errors.Is(err, errWorkloadKindChanged) || errors.Is(err, errReleaseInProgress) || errors.Is(err, errDiskChanged) {
+				return c.String(http.StatusConflict, fmt.Sprintf("Error applying deployment: %v", err))
+			}
+			if err != nil {
+				return c.String(http.StatusInternalServerError, fmt.Sprintf("Error applying deployment: %v", err))
+			}
+			return c.String(http.StatusOK, "Deployment applied successfully!")
+		}
+
+		err := createDeployment(clientset, tenantNamespace(c), req)
 		if err != nil {
-			return c.String(http.StatusInternalServerError, fmt.Sprintf("Error creating deployment: %v", err))
+			return creationError(c, "deployment", err)
 		}
 
 		return c.String(http.StatusCreated, "Deployment created successfully!")
 	})
 
-	e.POST("/deployments/ready/:appType", func(c echo.Context) error {
+	deployments.PUT("/:appName", func(c echo.Context) error {
 		req := new(DeploymentRequest)
-		appType := c.Param("appType")
 		if err := c.Bind(req); err != nil {
 			return c.String(http.StatusBadRequest, fmt.Sprintf("Error parsing request body: %v", err))
 		}
+		req.Tenant = tenantOf(c)
 
-		if appType == "postgres" {
-			postgrespass, err := password.Generate(64, 10, 10, false, false)
-			if err != nil {
-				log.Fatal(err)
+		appName := c.Param("appName")
+		if req.AppName == "" {
+			req.AppName = appName
+		}
+		if req.AppName != appName {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("App name in body (%v) does not match path (%v)", req.AppName, appName))
+		}
+		applyRequestDefaults(req)
+		if err := validateDeploymentRequest(req); err != nil {
+			return validationError(c, err)
+		}
+		if err := validateImagePullSecrets(clientset, tenantNamespace(c), req.ImagePullSecrets); err != nil {
+			return validationError(c, err)
+		}
+		if err := pinImageDigest(clientset, tenantNamespace(c), req); err != nil {
+			return digestError(c, err)
+		}
+
+		err := updateDeployment(clientset, tenantNamespace(c), req)
+		if apierrors.IsNotFound(err) {
+			return c.String(http.StatusNotFound, fmt.Sprintf("Error updating deployment: %v", err))
+		}
+		if errors.Is(err, errHostTaken) || errors.Is(err, errWorkloadKindChanged) || errors.Is(err, errReleaseInProgress) || errors.Is(err, errReleasePromoting) || errors.Is(err, errReleaseRoutingChanged) || errors.Is(err, errReleaseNameTaken) || errors.Is(err, errDiskChanged) {
+			return c.String(http.StatusConflict, fmt.Sprintf("Error updating deployment: %v", err))
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Error updating deployment: %v", err))
+		}
+
+		return c.String(http.StatusOK, "Deployment updated successfully!")
+	})
+
+	deployments.DELETE("/:appName", func(c echo.Context) error {
+		appName := c.Param("appName")
+		purgeVolumes := c.QueryParam("purgeVolumes") == "true"
+
+		result, err := deleteApp(clientset, tenantNamespace(c), appName, purgeVolumes)
+		if apierrors.IsNotFound(err) {
+			return c.String(http.StatusNotFound, fmt.Sprintf("Error deleting app: %v", err))
+		}
+		if err != nil {
+			if result != nil {
+				return c.JSON(http.StatusInternalServerError, echo.Map{"error": err.Error(), "deleted": result.Deleted})
 			}
-			log.Printf(postgrespass)
-			secrets := map[string]string{
-				"password": postgrespass,
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Error deleting app: %v", err))
+		}
+
+		return c.JSON(http.StatusOK, result)
+	})
+
+	deployments.PATCH("/:appName/scale", func(c echo.Context) error {
+		req := new(ScaleRequest)
+		if err := c.Bind(req); err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Error parsing request body: %v", err))
+		}
+		if err := validateScaleRequest(req); err != nil {
+			return validationError(c, err)
+		}
+
+		err := scaleApp(clientset, tenantNamespace(c), c.Param("appName"), req.Replicas)
+		if errors.Is(err, errAutoscaled) || errors.Is(err, errSharedDisk) {
+			return c.String(http.StatusConflict, fmt.Sprintf("Error scaling app: %v", err))
+		}
+		if apierrors.IsNotFound(err) {
+			return c.String(http.StatusNotFound, fmt.Sprintf("Error scaling app: %v", err))
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Error scaling app: %v", err))
+		}
+
+		return c.String(http.StatusOK, fmt.Sprintf("App scaled to %d replicas", req.Replicas))
+	})
+
+	deployments.POST("/:appName/release/promote", func(c echo.Context) error {
+		strategy, err := promoteRelease(clientset, tenantNamespace(c), c.Param("appName"))
+		if errors.Is(err, errNoRelease) {
+			return c.String(http.StatusNotFound, fmt.Sprintf("Error promoting release: %v", err))
+		}
+		if errors.Is(err, errReleaseNotReady) {
+			return c.String(http.StatusConflict, fmt.Sprintf("Error promoting release: %v", err))
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Error promoting release: %v", err))
+		}
+
+		if strategy == releaseBlueGreen {
+			return c.String(http.StatusAccepted, "Traffic switched to the release, the app is being updated to it")
+		}
+		return c.String(http.StatusOK, "Release promoted successfully!")
+	})
+
+	deployments.POST("/:appName/release/abort", func(c echo.Context) error {
+		err := abortRelease(clientset, tenantNamespace(c), c.Param("appName"))
+		if errors.Is(err, errNoRelease) {
+			return c.String(http.StatusNotFound, fmt.Sprintf("Error aborting release: %v", err))
+		}
+		if errors.Is(err, errReleasePromoting) {
+			return c.String(http.StatusConflict, fmt.Sprintf("Error aborting release: %v", err))
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Error aborting release: %v", err))
+		}
+
+		return c.String(http.StatusOK, "Release aborted successfully!")
+	})
+
+	deployments.GET("/:appName/revisions", func(c echo.Context) error {
+		revisions, err := getRevisions(clientset, tenantNamespace(c), c.Param("appName"))
+		if apierrors.IsNotFound(err) {
+			return c.String(http.StatusNotFound, fmt.Sprintf("Error fetching revisions: %v", err))
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Error fetching revisions: %v", err))
+		}
+
+		return c.JSON(http.StatusOK, revisions)
+	})
+
+	deployments.POST("/:appName/rollback", func(c echo.Context) error {
+		req := new(RollbackRequest)
+		if err := c.Bind(req); err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Error parsing request body: %v", err))
+		}
+
+		revision, err := rollbackDeployment(clientset, tenantNamespace(c), c.Param("appName"), req.Revision)
+		if apierrors.IsNotFound(err) {
+			return c.String(http.StatusNotFound, fmt.Sprintf("Error rolling back deployment: %v", err))
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Error rolling back deployment: %v", err))
+		}
+
+		return c.JSON(http.StatusOK, revision)
+	})
+
+	deployments.GET("/:appName/logs", func(c echo.Context) error {
+		req := new(LogRequest)
+		if err := c.Bind(req); err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Error parsing query: %v", err))
+		}
+
+		appName := c.Param("appName")
+		template, err := liveTemplate(clientset, tenantNamespace(c), appName)
+		if apierrors.IsNotFound(err) {
+			return c.String(http.StatusNotFound, fmt.Sprintf("Error fetching logs: %v", err))
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Error fetching logs: %v", err))
+		}
+		if err := validateLogRequest(req, template); err != nil {
+			return validationError(c, err)
+		}
+
+		// lines are written as they are read, followed logs as server-sent
+		// events and the others as plain text
+		format := "[%s] %s\n"
+		c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextPlainCharsetUTF8)
+		if req.Follow {
+			format = "data: [%s] %s\n\n"
+			c.Response().Header().Set(echo.HeaderContentType, "text/event-stream")
+			c.Response().Header().Set("Cache-Control", "no-cache")
+		}
+		c.Response().WriteHeader(http.StatusOK)
+		c.Response().Flush()
+
+		opts := podLogOptions(logContainer(appName, template, req), req)
+		err = streamLogs(c.Request().Context(), clientset, tenantNamespace(c), appName, opts, func(pod string, line string) error {
+			if _, err := fmt.Fprintf(c.Response(), format, pod, line); err != nil {
+				return err
+			}
+			c.Response().Flush()
+			return nil
+		})
+		// the status is sent already, so failures are reported in the stream
+		// unless the client went away
+		if err != nil && c.Request().Context().Err() == nil {
+			fmt.Printf("Error streaming logs of app %s in %s: %v\n", appName, tenantNamespace(c), err)
+			if req.Follow {
+				fmt.Fprintf(c.Response(), "event: error\ndata: %v\n\n", err)
+			} else {
+				fmt.Fprintf(c.Response(), "Error streaming logs: %v\n", err)
 			}
+		}
+		return nil
+	})
+
+	deployments.GET("/:appName/pods/:pod/exec", func(c echo.Context) error {
+		req := &ExecRequest{TTY: true}
+		if err := c.Bind(req); err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Error parsing query: %v", err))
+		}
+		if len(req.Command) == 0 {
+			req.Command = []string{"/bin/sh"}
+		}
 
-			req.ServicePort = 5432
-			req.DomainAddress = "postgres.kubernetes.local"
+		appName := c.Param("appName")
+		pod, err := getAppPod(clientset, tenantNamespace(c), appName, c.Param("pod"))
+		if err == nil {
+			err = validateExec(pod, req)
+		}
+		if apierrors.IsNotFound(err) {
+			return c.String(http.StatusNotFound, fmt.Sprintf("Error starting exec session: %v", err))
+		}
+		if errors.Is(err, errPodNotRunning) {
+			return c.String(http.StatusConflict, fmt.Sprintf("Error starting exec session: %v", err))
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Error starting exec session: %v", err))
+		}
+		container := execContainer(appName, pod, req)
 
-			_, err = createSecret(clientset, req.AppName, secrets)
-			if err != nil {
-				return c.String(http.StatusInternalServerError, fmt.Sprintf("Error creating secret: %v", err))
+		conn, err := execUpgrader.Upgrade(c.Response(), c.Request(), nil)
+		if err != nil {
+			// the upgrader has answered the request already
+			return nil
+		}
+
+		auditExec(clientset, pod, container, req, tenantOf(c), c.RealIP(), "session started")
+		start := time.Now()
+		exitCode, err := execInPod(c.Request().Context(), config, clientset, tenantNamespace(c), pod.Name, container, req, conn)
+		duration := time.Since(start).Round(time.Second)
+		if err != nil {
+			auditExec(clientset, pod, container, req, tenantOf(c), c.RealIP(), fmt.Sprintf("session failed after %s: %v", duration, err))
+			closeExecSession(conn, ExecStatus{Error: err.Error()})
+			return nil
+		}
+		auditExec(clientset, pod, container, req, tenantOf(c), c.RealIP(), fmt.Sprintf("session ended after %s with exit code %d", duration, exitCode))
+		closeExecSession(conn, ExecStatus{ExitCode: &exitCode})
+		return nil
+	})
+
+	deployments.POST("/:appName/run", func(c echo.Context) error {
+		req := new(RunRequest)
+		if err := c.Bind(req); err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Error parsing request body: %v", err))
+		}
+		if err := validateRunRequest(req); err != nil {
+			return validationError(c, err)
+		}
+
+		appName := c.Param("appName")
+		job, err := startRun(clientset, tenantNamespace(c), appName, tenantOf(c), req)
+		if apierrors.IsNotFound(err) {
+			return c.String(http.StatusNotFound, fmt.Sprintf("Error starting run: %v", err))
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Error starting run: %v", err))
+		}
+
+		// the output is streamed as it is logged, so failures past this
+		// point are reported in the last event rather than the status
+		c.Response().Header().Set(echo.HeaderContentType, "application/x-ndjson")
+		c.Response().WriteHeader(http.StatusOK)
+		encoder := json.NewEncoder(c.Response())
+		emit := func(event RunEvent) error {
+			if err := encoder.Encode(event); err != nil {
+				return err
 			}
+			c.Response().Flush()
+			return nil
+		}
+
+		exitCode, err := streamRun(c.Request().Context(), clientset, tenantNamespace(c), appName, job, emit)
+		result := RunEvent{Job: job.Name}
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.ExitCode = &exitCode
+		}
+		return emit(result)
+	})
 
-			err = createService(clientset, req)
+	deployments.POST("/ready/:appType", func(c echo.Context) error {
+		req := new(DeploymentRequest)
+		appType := c.Param("appType")
+		if err := c.Bind(req); err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Error parsing request body: %v", err))
+		}
+		req.Tenant = tenantOf(c)
+
+		if appType == "postgres" {
+			postgrespass, err := password.Generate(64, 10, 10, false, false)
 			if err != nil {
-				return c.String(http.StatusInternalServerError, fmt.Sprintf("Error creating service: %v", err))
+				log.Fatal(err)
 			}
 
-			if req.ExternalAccess {
-				err = createIngress(clientset, req)
-				if err != nil {
-					return c.String(http.StatusInternalServerError, fmt.Sprintf("Error creating ingress: %v", err))
-				}
+			applyPostgresDefaults(req)
+			applyRequestDefaults(req)
+			if err := validateDeploymentRequest(req); err != nil {
+				return validationError(c, err)
 			}
 
-			err = postgresStatefulSet(clientset, req)
+			err = createPostgres(clientset, tenantNamespace(c), req, postgrespass)
 			if err != nil {
-				return c.String(http.StatusInternalServerError, fmt.Sprintf("Error creating statefulset: %v", err))
+				return creationError(c, "deployment", err)
 			}
 
 			return c.String(http.StatusCreated, "Statefulset created successfully!/nPostgres password: "+postgrespass)
@@ -183,12 +525,221 @@ func main() {
 		}
 	})
 
+	// jobs run to completion, on their own or on the schedule of a cron job
+	jobs := e.Group("/jobs",
+		authMiddleware(authConfig),
+		tenantMiddleware(clientset),
+	)
+
+	jobs.GET("", func(c echo.Context) error {
+		jobsInfo, err := listJobs(clientset, tenantNamespace(c), tenantOf(c), jobLabel)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Error fetching jobs: %v", err))
+		}
+
+		return c.JSON(http.StatusOK, jobsInfo)
+	})
+
+	jobs.GET("/:name", func(c echo.Context) error {
+		jobInfo, err := getJobInfo(clientset, tenantNamespace(c), tenantOf(c), c.Param("name"))
+		if apierrors.IsNotFound(err) {
+			return c.String(http.StatusNotFound, fmt.Sprintf("Error fetching job: %v", err))
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Error fetching job: %v", err))
+		}
+
+		return c.JSON(http.StatusOK, jobInfo)
+	})
+
+	jobs.POST("", func(c echo.Context) error {
+		req := new(JobRequest)
+		if err := c.Bind(req); err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Error parsing request body: %v", err))
+		}
+		req.Tenant = tenantOf(c)
+		expandResourcePreset(&req.Resources)
+		if err := validateJobRequest(req); err != nil {
+			return validationError(c, err)
+		}
+		if err := validateImagePullSecrets(clientset, tenantNamespace(c), req.ImagePullSecrets); err != nil {
+			return validationError(c, err)
+		}
+
+		err := createJob(clientset, tenantNamespace(c), req)
+		if err != nil {
+			return creationError(c, "job", err)
+		}
+
+		return c.String(http.StatusCreated, "Job created successfully!")
+	})
+
+	jobs.DELETE("/:name", func(c echo.Context) error {
+		err := deleteJob(clientset, tenantNamespace(c), tenantOf(c), c.Param("name"))
+		if apierrors.IsNotFound(err) {
+			return c.String(http.StatusNotFound, fmt.Sprintf("Error deleting job: %v", err))
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Error deleting job: %v", err))
+		}
+
+		return c.String(http.StatusOK, "Job deleted successfully!")
+	})
+
+	cronJobs := e.Group("/cronjobs",
+		authMiddleware(authConfig),
+		tenantMiddleware(clientset),
+	)
+
+	cronJobs.GET("", func(c echo.Context) error {
+		cronJobsInfo, err := listCronJobs(clientset, tenantNamespace(c), tenantOf(c))
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Error fetching cron jobs: %v", err))
+		}
+
+		return c.JSON(http.StatusOK, cronJobsInfo)
+	})
+
+	cronJobs.GET("/:name", func(c echo.Context) error {
+		cronJobInfo, err := getCronJobInfo(clientset, tenantNamespace(c), tenantOf(c), c.Param("name"))
+		if apierrors.IsNotFound(err) {
+			return c.String(http.StatusNotFound, fmt.Sprintf("Error fetching cron job: %v", err))
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Error fetching cron job: %v", err))
+		}
+
+		return c.JSON(http.StatusOK, cronJobInfo)
+	})
+
+	cronJobs.POST("", func(c echo.Context) error {
+		req := new(CronJobRequest)
+		if err := c.Bind(req); err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Error parsing request body: %v", err))
+		}
+		req.Tenant = tenantOf(c)
+		expandResourcePreset(&req.Resources)
+		if err := validateCronJobRequest(req); err != nil {
+			return validationError(c, err)
+		}
+		if err := validateImagePullSecrets(clientset, tenantNamespace(c), req.ImagePullSecrets); err != nil {
+			return validationError(c, err)
+		}
+
+		err := createCronJob(clientset, tenantNamespace(c), req)
+		if err != nil {
+			return creationError(c, "cron job", err)
+		}
+
+		return c.String(http.StatusCreated, "Cron job created successfully!")
+	})
+
+	cronJobs.POST("/:name/trigger", func(c echo.Context) error {
+		jobInfo, err := triggerCronJob(clientset, tenantNamespace(c), tenantOf(c), c.Param("name"))
+		if apierrors.IsNotFound(err) {
+			return c.String(http.StatusNotFound, fmt.Sprintf("Error triggering cron job: %v", err))
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Error triggering cron job: %v", err))
+		}
+
+		return c.JSON(http.StatusCreated, jobInfo)
+	})
+
+	cronJobs.DELETE("/:name", func(c echo.Context) error {
+		err := deleteCronJob(clientset, tenantNamespace(c), tenantOf(c), c.Param("name"))
+		if apierrors.IsNotFound(err) {
+			return c.String(http.StatusNotFound, fmt.Sprintf("Error deleting cron job: %v", err))
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Error deleting cron job: %v", err))
+		}
+
+		return c.String(http.StatusOK, "Cron job deleted successfully!")
+	})
+
+	// registry credentials are shared by all apps of a tenant and referenced
+	// by name from imagePullSecrets
+	registries := e.Group("/registries",
+		authMiddleware(authConfig),
+		tenantMiddleware(clientset),
+	)
+
+	registries.GET("", func(c echo.Context) error {
+		credentials, err := getRegistryCredentials(clientset, tenantNamespace(c), tenantOf(c))
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Error fetching registry credentials: %v", err))
+		}
+
+		return c.JSON(http.StatusOK, credentials)
+	})
+
+	registries.POST("", func(c echo.Context) error {
+		req := new(RegistryCredentialRequest)
+		if err := c.Bind(req); err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Error parsing request body: %v", err))
+		}
+		if err := validateRegistryCredentialRequest(req); err != nil {
+			return validationError(c, err)
+		}
+
+		err := createRegistryCredential(clientset, tenantNamespace(c), tenantOf(c), req)
+		if apierrors.IsAlreadyExists(err) {
+			return c.String(http.StatusConflict, fmt.Sprintf("Error creating registry credential: %v", err))
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Error creating registry credential: %v", err))
+		}
+
+		return c.String(http.StatusCreated, "Registry credential created successfully!")
+	})
+
+	registries.PUT("/:name", func(c echo.Context) error {
+		req := new(RegistryCredentialRequest)
+		if err := c.Bind(req); err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Error parsing request body: %v", err))
+		}
+
+		name := c.Param("name")
+		if req.Name == "" {
+			req.Name = name
+		}
+		if req.Name != name {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("Registry credential name in body (%v) does not match path (%v)", req.Name, name))
+		}
+		if err := validateRegistryCredentialRequest(req); err != nil {
+			return validationError(c, err)
+		}
+
+		err := updateRegistryCredential(clientset, tenantNamespace(c), tenantOf(c), req)
+		if apierrors.IsNotFound(err) {
+			return c.String(http.StatusNotFound, fmt.Sprintf("Error updating registry credential: %v", err))
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Error updating registry credential: %v", err))
+		}
+
+		return c.String(http.StatusOK, "Registry credential updated successfully!")
+	})
+
+	registries.DELETE("/:name", func(c echo.Context) error {
+		err := deleteRegistryCredential(clientset, tenantNamespace(c), c.Param("name"))
+		if apierrors.IsNotFound(err) {
+			return c.String(http.StatusNotFound, fmt.Sprintf("Error deleting registry credential: %v", err))
+		}
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("Error deleting registry credential: %v", err))
+		}
+
+		return c.String(http.StatusOK, "Registry credential deleted successfully!")
+	})
+
 	e.GET("/healthz", func(c echo.Context) error {
 		return c.NoContent(http.StatusOK)
 	})
 
 	e.GET("/readiness", func(c echo.Context) error {
-		_, err := getAllDeploymentsInfo(clientset)
+		_, err := getAllDeploymentsInfo(clientset, corev1.NamespaceDefault, "")
 		if err != nil {
 			return c.String(http.StatusInternalServerError, fmt.Sprintf("Readiness check failed: %v", err))
 		}
@@ -196,7 +747,7 @@ func main() {
 	})
 
 	e.GET("/startup", func(c echo.Context) error {
-		_, err := getAllDeploymentsInfo(clientset)
+		_, err := getAllDeploymentsInfo(clientset, corev1.NamespaceDefault, "")
 		if err != nil {
 			return c.String(http.StatusInternalServerError, fmt.Sprintf("Startup check failed: %v", err))
 		}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+// serviceTypeHeadless asks for a ClusterIP service without a cluster IP,
+// resolving straight to the pod IPs.
+const serviceTypeHeadless = "Headless"
+
+var serviceTypes = []string{
+	string(corev1.ServiceTypeClusterIP),
+	string(corev1.ServiceTypeNodePort),
+	string(corev1.ServiceTypeLoadBalancer),
+	serviceTypeHeadless,
+}
+
+// appPorts returns the ports of req, or its single ServicePort for requests
+// that do not list named ports.
+func appPorts(req *DeploymentRequest) []PortRequest {
+	if len(req.Ports) > 0 {
+		return req.Ports
+	}
+	return []PortRequest{{Port: req.ServicePort}}
+}
+
+// primaryPort is the port the ingress routes to and the default probes
+// check: the one matching ServicePort, or else the first one.
+func primaryPort(req *DeploymentRequest) PortRequest {
+	ports := appPorts(req)
+	for _, port := range ports {
+		if port.Port == req.ServicePort {
+			return port
+		}
+	}
+	return ports[0]
+}
+
+// containerPort is the port the container listens on, which defaults to
+// the service port.
+func (p PortRequest) containerPort() int32 {
+	if p.TargetPort > 0 {
+		return p.TargetPort
+	}
+	return p.Port
+}
+
+func (p PortRequest) protocol() corev1.Protocol {
+	if p.Protocol == "" {
+		return corev1.ProtocolTCP
+	}
+	return corev1.Protocol(p.Protocol)
+}
+
+func buildContainerPorts(req *DeploymentRequest) []corev1.ContainerPort {
+	var ports []corev1.ContainerPort
+	for _, port := range appPorts(req) {
+		ports = append(ports, corev1.ContainerPort{
+			Name:          port.Name,
+			ContainerPort: port.containerPort(),
+			Protocol:      port.protocol(),
+		})
+	}
+	return ports
+}
+
+func buildServicePorts(req *DeploymentRequest) []corev1.ServicePort {
+	var ports []corev1.ServicePort
+	for _, port := range appPorts(req) {
+		servicePort := corev1.ServicePort{
+			Name:       port.Name,
+			Port:       port.Port,
+			TargetPort: intstr.FromInt32(port.containerPort()),
+			Protocol:   port.protocol(),
+			NodePort:   port.NodePort,
+		}
+		if port.AppProtocol != "" {
+			servicePort.AppProtocol = &port.AppProtocol
+		}
+		ports = append(ports, servicePort)
+	}
+	return ports
+}
+
+// setServiceType sets the type of spec as requested by req, ClusterIP when
+// none is given.
+func setServiceType(spec *corev1.ServiceSpec, req *DeploymentRequest) {
+	switch req.ServiceType {
+	case "":
+		spec.Type = corev1.ServiceTypeClusterIP
+	case serviceTypeHeadless:
+		spec.Type = corev1.ServiceTypeClusterIP
+		spec.ClusterIP = corev1.ClusterIPNone
+	default:
+		spec.Type = corev1.ServiceType(req.ServiceType)
+	}
+}
+
+// serviceRecreateRequired reports whether live has to be replaced to become
+// desired, as the cluster IP of a service cannot be added or removed.
+func serviceRecreateRequired(live *corev1.Service, desired *corev1.Service) bool {
+	return (live.Spec.ClusterIP == corev1.ClusterIPNone) != (desired.Spec.ClusterIP == corev1.ClusterIPNone)
+}
+
+// keepNodePorts copies the node ports allocated to live onto the ports of
+// desired that do not ask for one, so updates do not reallocate them.
+func keepNodePorts(live *corev1.Service, desired *corev1.Service) {
+	if desired.Spec.Type != corev1.ServiceTypeNodePort && desired.Spec.Type != corev1.ServiceTypeLoadBalancer {
+		return
+	}
+	for i := range desired.Spec.Ports {
+		port := &desired.Spec.Ports[i]
+		if port.NodePort != 0 {
+			continue
+		}
+		for _, livePort := range live.Spec.Ports {
+			if livePort.Port == port.Port && livePort.Protocol == port.Protocol {
+				port.NodePort = livePort.NodePort
+			}
+		}
+	}
+}
+
+// getServiceInfo returns the type and the allocated addresses of the
+// service of appName, or nil if it has none.
+func getServiceInfo(clientset *kubernetes.Clientset, namespace string, appName string) (*ServiceInfo, error) {
+	service, err := clientset.CoreV1().Services(namespace).Get(context.TODO(), serviceName(appName), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching service: %v", err)
+	}
+
+	info := &ServiceInfo{
+		Type:      string(service.Spec.Type),
+		ClusterIP: service.Spec.ClusterIP,
+		Ports:     make([]ServicePortInfo, 0, len(service.Spec.Ports)),
+	}
+	if service.Spec.ClusterIP == corev1.ClusterIPNone {
+		info.Type = serviceTypeHeadless
+	}
+	for _, port := range service.Spec.Ports {
+		info.Ports = append(info.Ports, ServicePortInfo{
+			Name:     port.Name,
+			Port:     port.Port,
+			Protocol: string(port.Protocol),
+			NodePort: port.NodePort,
+		})
+	}
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		if ingress.IP != "" {
+			info.LoadBalancerAddresses = append(info.LoadBalancerAddresses, ingress.IP)
+		}
+		if ingress.Hostname != "" {
+			info.LoadBalancerAddresses = append(info.LoadBalancerAddresses, ingress.Hostname)
+		}
+	}
+
+	return info, nil
+}
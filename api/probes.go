@@ -0,0 +1,113 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// Probe types a ProbeRequest can ask for. probeNone turns a default probe
+// off.
+const (
+	probeHTTP = "http"
+	probeTCP  = "tcp"
+	probeExec = "exec"
+	probeGRPC = "grpc"
+	probeNone = "none"
+)
+
+var probeTypes = []string{probeHTTP, probeTCP, probeExec, probeGRPC, probeNone}
+
+// buildProbes returns the liveness, readiness and startup probes of the app
+// container. Probes that are not requested default to a TCP check of the
+// primary port, and the startup probe gives slow apps a few minutes before
+// the liveness probe may restart them.
+func buildProbes(req *DeploymentRequest) (liveness, readiness, startup *corev1.Probe) {
+	liveness = buildProbe(req, req.Probes.Liveness, &corev1.Probe{
+		PeriodSeconds:    10,
+		TimeoutSeconds:   1,
+		SuccessThreshold: 1,
+		FailureThreshold: 3,
+	})
+	readiness = buildProbe(req, req.Probes.Readiness, &corev1.Probe{
+		PeriodSeconds:    5,
+		TimeoutSeconds:   1,
+		SuccessThreshold: 1,
+		FailureThreshold: 3,
+	})
+	startup = buildProbe(req, req.Probes.Startup, &corev1.Probe{
+		PeriodSeconds:    5,
+		TimeoutSeconds:   1,
+		SuccessThreshold: 1,
+		FailureThreshold: 60,
+	})
+	return liveness, readiness, startup
+}
+
+// buildProbe fills defaults with the handler and timings of probe, or a TCP
+// check of the service port when probe is nil.
+func buildProbe(req *DeploymentRequest, probe *ProbeRequest, defaults *corev1.Probe) *corev1.Probe {
+	if probe == nil {
+		// a UDP port cannot be checked with a TCP connection
+		if primaryPort(req).protocol() != corev1.ProtocolTCP {
+			return nil
+		}
+		probe = &ProbeRequest{Type: probeTCP}
+	}
+
+	port := probe.Port
+	if port == 0 {
+		port = primaryPort(req).containerPort()
+	}
+
+	result := defaults
+	switch probe.Type {
+	case probeHTTP:
+		path := probe.Path
+		if path == "" {
+			path = "/"
+		}
+		result.HTTPGet = &corev1.HTTPGetAction{
+			Path:   path,
+			Port:   intstr.FromInt32(port),
+			Scheme: corev1.URIScheme(probe.Scheme),
+		}
+		if result.HTTPGet.Scheme == "" {
+			result.HTTPGet.Scheme = corev1.URISchemeHTTP
+		}
+	case probeTCP:
+		result.TCPSocket = &corev1.TCPSocketAction{
+			Port: intstr.FromInt32(port),
+		}
+	case probeExec:
+		result.Exec = &corev1.ExecAction{
+			Command: probe.Command,
+		}
+	case probeGRPC:
+		result.GRPC = &corev1.GRPCAction{
+			Port: port,
+		}
+		if probe.Service != "" {
+			result.GRPC.Service = &probe.Service
+		}
+	default:
+		return nil
+	}
+
+	timings := []struct {
+		value  int32
+		target *int32
+	}{
+		{probe.InitialDelaySeconds, &result.InitialDelaySeconds},
+		{probe.PeriodSeconds, &result.PeriodSeconds},
+		{probe.TimeoutSeconds, &result.TimeoutSeconds},
+		{probe.SuccessThreshold, &result.SuccessThreshold},
+		{probe.FailureThreshold, &result.FailureThreshold},
+	}
+	for _, t := range timings {
+		if t.value > 0 {
+			*t.target = t.value
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	registryLabel            = "kaasapi/registry-credential"
+	registryServerAnnotation = "kaasapi/registry-server"
+)
+
+// registrySecretName is the dockerconfigjson secret holding the registry
+// credential name. App names cannot contain dots, so no secret derived from
+// an app can take it.
+func registrySecretName(name string) string {
+	return "registry." + name
+}
+
+// dockerConfigJSON is the format of the .dockerconfigjson key the kubelet
+// reads pull credentials from.
+type dockerConfigJSON struct {
+	Auths map[string]dockerConfigEntry `json:"auths"`
+}
+
+type dockerConfigEntry struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email,omitempty"`
+	Auth     string `json:"auth"`
+}
+
+func buildRegistrySecret(tenant string, req *RegistryCredentialRequest) (*corev1.Secret, error) {
+	config := dockerConfigJSON{
+		Auths: map[string]dockerConfigEntry{
+			req.Server: {
+				Username: req.Username,
+				Password: req.Password,
+				Email:    req.Email,
+				Auth:     base64.StdEncoding.EncodeToString([]byte(req.Username + ":" + req.Password)),
+			},
+		},
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding docker config: %v", err)
+	}
+
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: registrySecretName(req.Name),
+			Labels: map[string]string{
+				registryLabel: req.Name,
+				tenantLabel:   tenant,
+			},
+			Annotations: map[string]string{
+				registryServerAnnotation: req.Server,
+			},
+		},
+		Type: corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: data,
+		},
+	}, nil
+}
+
+func createRegistryCredential(clientset *kubernetes.Clientset, namespace string, tenant string, req *RegistryCredentialRequest) error {
+	secret, err := buildRegistrySecret(tenant, req)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Creating registry credential...")
+	_, err = clientset.CoreV1().Secrets(namespace).Create(context.TODO(), secret, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func updateRegistryCredential(clientset *kubernetes.Clientset, namespace string, tenant string, req *RegistryCredentialRequest) error {
+	secretsClient := clientset.CoreV1().Secrets(namespace)
+	secret, err := getRegistrySecret(clientset, namespace, req.Name)
+	if err != nil {
+		return err
+	}
+
+	desired, err := buildRegistrySecret(tenant, req)
+	if err != nil {
+		return err
+	}
+	secret.Data = desired.Data
+	metav1.SetMetaDataAnnotation(&secret.ObjectMeta, registryServerAnnotation, req.Server)
+
+	fmt.Println("Updating registry credential...")
+	_, err = secretsClient.Update(context.TODO(), secret, metav1.UpdateOptions{})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func deleteRegistryCredential(clientset *kubernetes.Clientset, namespace string, name string) error {
+	secret, err := getRegistrySecret(clientset, namespace, name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Deleting registry credential...")
+	return clientset.CoreV1().Secrets(namespace).Delete(context.TODO(), secret.Name, metav1.DeleteOptions{})
+}
+
+// getRegistrySecret returns the secret of the registry credential name, or
+// a not found error for secrets that are not registry credentials.
+func getRegistrySecret(clientset *kubernetes.Clientset, namespace string, name string) (*corev1.Secret, error) {
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(context.TODO(), registrySecretName(name), metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if secret.Labels[registryLabel] != name {
+		return nil, apierrors.NewNotFound(corev1.Resource("secrets"), registrySecretName(name))
+	}
+	return secret, nil
+}
+
+// getRegistryCredentials lists the registry credentials of tenant. The
+// passwords are never returned.
+func getRegistryCredentials(clientset *kubernetes.Clientset, namespace string, tenant string) ([]RegistryCredentialInfo, error) {
+	selector := labels.SelectorFromSet(labels.Set{tenantLabel: tenant}).String() + "," + registryLabel
+	secretList, err := clientset.CoreV1().Secrets(namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: selector,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing registry credentials: %v", err)
+	}
+
+	credentials := make([]RegistryCredentialInfo, 0, len(secretList.Items))
+	for _, secret := range secretList.Items {
+		info := RegistryCredentialInfo{
+			Name:      secret.Labels[registryLabel],
+			Server:    secret.Annotations[registryServerAnnotation],
+			CreatedAt: secret.CreationTimestamp,
+		}
+		var config dockerConfigJSON
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &config); err == nil {
+			info.Username = config.Auths[info.Server].Username
+		}
+		credentials = append(credentials, info)
+	}
+
+	return credentials, nil
+}
+
+// buildImagePullSecrets references the registry credentials names to pull
+// images with.
+func buildImagePullSecrets(names []string) []corev1.LocalObjectReference {
+	var refs []corev1.LocalObjectReference
+	for _, name := range names {
+		refs = append(refs, corev1.LocalObjectReference{Name: registrySecretName(name)})
+	}
+	return refs
+}
+
+// validateImagePullSecrets checks that every registry credential in names
+// is registered for the tenant, since pods would otherwise be stuck failing
+// to pull their images.
+func validateImagePullSecrets(clientset *kubernetes.Clientset, namespace string, names []string) *ValidationError {
+	var errs field.ErrorList
+	for i, name := range names {
+		path := field.NewPath("imagePullSecrets").Index(i)
+		_, err := getRegistrySecret(clientset, namespace, name)
+		if apierrors.IsNotFound(err) {
+			errs = append(errs, field.NotFound(path, name))
+		} else if err != nil {
+			errs = append(errs, field.InternalError(path, err))
+		}
+	}
+	return toValidationError(errs)
+}
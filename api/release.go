@@ -0,0 +1,663 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Release strategies an update can be rolled out with. Rolling updates the
+// Deployment in place, blue/green and canary releases run the new version
+// in a Deployment of its own next to the stable one until it is promoted.
+const (
+	releaseRolling   = "rolling"
+	releaseBlueGreen = "blueGreen"
+	releaseCanary    = "canary"
+)
+
+var releaseStrategies = []string{releaseRolling, releaseBlueGreen, releaseCanary}
+
+const (
+	releaseOfLabel       = "kaasapi/release-of"
+	releaseStrategyLabel = "kaasapi/release-strategy"
+
+	nginxCanaryAnnotation       = "nginx.ingress.kubernetes.io/canary"
+	nginxCanaryWeightAnnotation = "nginx.ingress.kubernetes.io/canary-weight"
+
+	defaultCanaryWeight = 10
+
+	// releaseRolloutTimeout bounds how long a promoted blue/green release
+	// keeps serving while the stable Deployment is rolled out to it.
+	releaseRolloutTimeout = 15 * time.Minute
+)
+
+var (
+	errReleaseInProgress = errors.New("another release of the app is in progress, promote or abort it first")
+	errReleasePromoting  = errors.New("the release is being promoted")
+	errReleaseNotReady   = errors.New("the release is not ready yet")
+	errNoRelease         = errors.New("the app has no release in progress")
+
+	// errReleaseRoutingChanged is returned for releases that change how the
+	// app is reached. Those objects are shared with the stable pods, so the
+	// change would go live before the release is promoted and outlive an
+	// abort.
+	errReleaseRoutingChanged = errors.New("a release cannot change the service, ingress, TLS or basic auth of the app, update them without a release strategy")
+
+	// errReleaseNameTaken is returned when an object named like the release
+	// of an app belongs to something else, such as an app created before
+	// those names were reserved.
+	errReleaseNameTaken = errors.New("the name of the release is taken by another object")
+)
+
+func releaseStrategy(req *DeploymentRequest) string {
+	if req.Release == nil || req.Release.Strategy == "" {
+		return releaseRolling
+	}
+	return req.Release.Strategy
+}
+
+// isRelease reports whether req is rolled out next to the stable version
+// rather than in place.
+func isRelease(req *DeploymentRequest) bool {
+	return releaseStrategy(req) != releaseRolling
+}
+
+func releaseName(appName string, strategy string) string {
+	if strategy == releaseCanary {
+		return appName + "-canary"
+	}
+	return appName + "-green"
+}
+
+func canaryWeight(req *DeploymentRequest) int32 {
+	if req.Release == nil || req.Release.CanaryWeight == 0 {
+		return defaultCanaryWeight
+	}
+	return req.Release.CanaryWeight
+}
+
+// getRelease returns the Deployment of the release of appName in progress,
+// or nil if there is none.
+func getRelease(clientset *kubernetes.Clientset, namespace string, appName string) (*appsv1.Deployment, error) {
+	deploymentList, err := clientset.AppsV1().Deployments(namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", releaseOfLabel, appName),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing releases: %w", err)
+	}
+	if len(deploymentList.Items) == 0 {
+		return nil, nil
+	}
+	return &deploymentList.Items[0], nil
+}
+
+// checkRelease makes sure req may be rolled out next to a release of the
+// app in progress: only the release itself can be updated, and only until
+// it is promoted.
+func checkRelease(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	release, err := getRelease(clientset, namespace, req.AppName)
+	if err != nil || release == nil {
+		return err
+	}
+	if release.Labels[releaseStrategyLabel] != releaseStrategy(req) {
+		return errReleaseInProgress
+	}
+
+	promoting, err := servesRelease(clientset, namespace, req.AppName)
+	if err != nil {
+		return err
+	}
+	if promoting {
+		return errReleasePromoting
+	}
+
+	return nil
+}
+
+// checkReleaseRouting makes sure req leaves the service, TLS secret, basic
+// auth secret and ingress of the app as they are, since releases only roll
+// out the pods.
+func checkReleaseRouting(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	service, err := clientset.CoreV1().Services(namespace).Get(context.TODO(), serviceName(req.AppName), metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error fetching service: %w", err)
+	}
+	desiredService := buildService(req)
+	keepNodePorts(service, desiredService)
+	if service.Spec.Type != desiredService.Spec.Type || serviceRecreateRequired(service, desiredService) ||
+		!apiequality.Semantic.DeepEqual(service.Spec.Ports, desiredService.Spec.Ports) {
+		return fmt.Errorf("%w: the service ports or type differ", errReleaseRoutingChanged)
+	}
+
+	secretsClient := clientset.CoreV1().Secrets(namespace)
+	tlsSecret, err := secretsClient.Get(context.TODO(), tlsSecretName(req.AppName), metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error fetching TLS secret: %w", err)
+	}
+	exists := err == nil
+	if uploadsCertificate(req) {
+		if !exists || !apiequality.Semantic.DeepEqual(tlsSecret.Data, buildTLSSecret(req).Data) {
+			return fmt.Errorf("%w: the certificate differs", errReleaseRoutingChanged)
+		}
+	} else if exists && tlsSecret.Annotations[certManagerCertificateAnnotation] == "" {
+		return fmt.Errorf("%w: the certificate would be removed", errReleaseRoutingChanged)
+	}
+
+	basicAuthSecret, err := secretsClient.Get(context.TODO(), basicAuthSecretName(req.AppName), metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error fetching basic auth secret: %w", err)
+	}
+	exists = err == nil
+	if exists != usesBasicAuth(req) {
+		return fmt.Errorf("%w: basic auth would be added or removed", errReleaseRoutingChanged)
+	}
+	if exists {
+		desired, err := buildBasicAuthSecret(req, basicAuthSecret)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(basicAuthSecret.Data["auth"], desired.Data["auth"]) {
+			return fmt.Errorf("%w: the basic auth credentials differ", errReleaseRoutingChanged)
+		}
+	}
+
+	ingress, err := clientset.NetworkingV1().Ingresses(namespace).Get(context.TODO(), ingressName(req.AppName), metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error fetching ingress: %w", err)
+	}
+	exists = err == nil
+	if exists != req.ExternalAccess {
+		return fmt.Errorf("%w: external access differs", errReleaseRoutingChanged)
+	}
+	if !exists {
+		return nil
+	}
+	desiredIngress := buildIngress(req)
+	changed := !apiequality.Semantic.DeepEqual(ingress.Spec.Rules, desiredIngress.Spec.Rules) ||
+		!apiequality.Semantic.DeepEqual(ingress.Spec.TLS, desiredIngress.Spec.TLS) ||
+		(desiredIngress.Spec.IngressClassName != nil && !apiequality.Semantic.DeepEqual(ingress.Spec.IngressClassName, desiredIngress.Spec.IngressClassName))
+	for _, key := range ownedIngressAnnotations {
+		if ingress.Annotations[key] != desiredIngress.Annotations[key] {
+			changed = true
+		}
+	}
+	if changed {
+		return fmt.Errorf("%w: the ingress differs", errReleaseRoutingChanged)
+	}
+
+	return nil
+}
+
+// servesRelease reports whether the service of appName has already been
+// switched over to its blue/green release.
+func servesRelease(clientset *kubernetes.Clientset, namespace string, appName string) (bool, error) {
+	service, err := clientset.CoreV1().Services(namespace).Get(context.TODO(), serviceName(appName), metav1.GetOptions{})
+	if err != nil {
+		return false, fmt.Errorf("error fetching service: %w", err)
+	}
+	return service.Spec.Selector["app"] == releaseName(appName, releaseBlueGreen), nil
+}
+
+// pinSnapshotRefs points the references of template to the live config map
+// and secret of appName at their snapshots, or back again when pin is
+// false. Releases run on snapshots so the live config keeps matching the
+// stable pods until the release is promoted.
+func pinSnapshotRefs(template *corev1.PodTemplateSpec, appName string, pin bool) {
+	hash := template.Annotations[configHashAnnotation]
+	configFrom, configTo := configMapName(appName), configSnapshotName(appName, hash)
+	secretFrom, secretTo := secretName(appName), secretSnapshotName(appName, hash)
+	if !pin {
+		configFrom, configTo = configTo, configFrom
+		secretFrom, secretTo = secretTo, secretFrom
+	}
+	rename := func(name *string, from string, to string) {
+		if *name == from {
+			*name = to
+		}
+	}
+
+	spec := &template.Spec
+	for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+		for i := range containers {
+			for _, envFrom := range containers[i].EnvFrom {
+				if envFrom.ConfigMapRef != nil {
+					rename(&envFrom.ConfigMapRef.Name, configFrom, configTo)
+				}
+				if envFrom.SecretRef != nil {
+					rename(&envFrom.SecretRef.Name, secretFrom, secretTo)
+				}
+			}
+			for _, env := range containers[i].Env {
+				if env.ValueFrom != nil && env.ValueFrom.ConfigMapKeyRef != nil {
+					rename(&env.ValueFrom.ConfigMapKeyRef.Name, configFrom, configTo)
+				}
+				if env.ValueFrom != nil && env.ValueFrom.SecretKeyRef != nil {
+					rename(&env.ValueFrom.SecretKeyRef.Name, secretFrom, secretTo)
+				}
+			}
+		}
+	}
+	for _, volume := range spec.Volumes {
+		if volume.ConfigMap != nil {
+			rename(&volume.ConfigMap.Name, configFrom, configTo)
+		}
+		if volume.Secret != nil {
+			rename(&volume.Secret.SecretName, secretFrom, secretTo)
+		}
+	}
+}
+
+// buildReleaseDeployment builds the Deployment running the release of req.
+// Its pods carry their own app label, so the service of the app keeps
+// selecting only the stable pods. A blue/green release is sized to take
+// over all traffic, a canary one to the share of traffic it receives.
+func buildReleaseDeployment(req *DeploymentRequest, stableReplicas int32) *appsv1.Deployment {
+	strategy := releaseStrategy(req)
+	name := releaseName(req.AppName, strategy)
+
+	deployment := buildDeployment(req)
+	deployment.Name = name
+	deployment.Labels[releaseOfLabel] = req.AppName
+	deployment.Labels[releaseStrategyLabel] = strategy
+	deployment.Spec.Selector.MatchLabels = map[string]string{
+		"app": name,
+	}
+	deployment.Spec.Template.Labels = map[string]string{
+		"app":          name,
+		releaseOfLabel: req.AppName,
+	}
+	pinSnapshotRefs(&deployment.Spec.Template, req.AppName, true)
+
+	replicas := max(initialReplicas(req), stableReplicas)
+	if strategy == releaseCanary {
+		replicas = max((stableReplicas*canaryWeight(req)+99)/100, 1)
+	}
+	deployment.Spec.Replicas = int32Ptr(replicas)
+
+	return deployment
+}
+
+// buildCanaryService builds the service the canary ingress routes to.
+func buildCanaryService(req *DeploymentRequest) *corev1.Service {
+	name := releaseName(req.AppName, releaseCanary)
+
+	service := buildService(req)
+	service.Name = serviceName(name)
+	service.Labels[releaseOfLabel] = req.AppName
+	service.Spec.Selector = map[string]string{
+		"app": name,
+	}
+	service.Spec.Type = corev1.ServiceTypeClusterIP
+	service.Spec.ClusterIP = ""
+	for i := range service.Spec.Ports {
+		service.Spec.Ports[i].NodePort = 0
+	}
+
+	return service
+}
+
+// buildCanaryIngress builds the ingress sending the canary weight of the
+// traffic for the hosts and paths of the app to its canary. The controller
+// applies the options of the main ingress to canary traffic as well, and TLS
+// stays with the main ingress, so only the canary annotations are set.
+func buildCanaryIngress(req *DeploymentRequest) *networkingv1.Ingress {
+	name := releaseName(req.AppName, releaseCanary)
+
+	ingress := buildIngress(req)
+	ingress.Name = ingressName(name)
+	ingress.Labels[releaseOfLabel] = req.AppName
+	ingress.Annotations = map[string]string{
+		nginxCanaryAnnotation:       "true",
+		nginxCanaryWeightAnnotation: strconv.Itoa(int(canaryWeight(req))),
+	}
+	ingress.Spec.TLS = nil
+	for _, rule := range ingress.Spec.Rules {
+		for _, path := range rule.HTTP.Paths {
+			path.Backend.Service.Name = serviceName(name)
+		}
+	}
+
+	return ingress
+}
+
+// reconcileRelease creates or updates the release of req. A new release is
+// created as a whole or not at all.
+func reconcileRelease(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	stable, err := clientset.AppsV1().Deployments(namespace).Get(context.TODO(), req.AppName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("deployment not found: %w", err)
+	}
+	desired := buildReleaseDeployment(req, *stable.Spec.Replicas)
+
+	deploymentsClient := clientset.AppsV1().Deployments(namespace)
+	release, err := deploymentsClient.Get(context.TODO(), desired.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		err = createRelease(clientset, namespace, req, desired)
+		if apierrors.IsAlreadyExists(err) {
+			return fmt.Errorf("%w: %v", errReleaseNameTaken, err)
+		}
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("error fetching release: %w", err)
+	}
+	if err := checkReleaseOf(release.ObjectMeta, req.AppName); err != nil {
+		return err
+	}
+	var service *corev1.Service
+	var ingress *networkingv1.Ingress
+	if releaseStrategy(req) == releaseCanary {
+		service, err = clientset.CoreV1().Services(namespace).Get(context.TODO(), serviceName(release.Name), metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("error fetching canary service: %w", err)
+		}
+		if err := checkReleaseOf(service.ObjectMeta, req.AppName); err != nil {
+			return err
+		}
+		ingress, err = clientset.NetworkingV1().Ingresses(namespace).Get(context.TODO(), ingressName(release.Name), metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("error fetching canary ingress: %w", err)
+		}
+		if err := checkReleaseOf(ingress.ObjectMeta, req.AppName); err != nil {
+			return err
+		}
+	}
+
+	release.Spec.Replicas = desired.Spec.Replicas
+	release.Spec.Template = desired.Spec.Template
+	metav1.SetMetaDataAnnotation(&release.ObjectMeta, changeCauseAnnotation, changeCause(req))
+
+	fmt.Println("Updating release...")
+	_, err = deploymentsClient.Update(context.TODO(), release, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("error updating release: %w", err)
+	}
+
+	if releaseStrategy(req) != releaseCanary {
+		return nil
+	}
+
+	service.Spec.Ports = buildCanaryService(req).Spec.Ports
+	fmt.Println("Updating canary service...")
+	_, err = clientset.CoreV1().Services(namespace).Update(context.TODO(), service, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("error updating canary service: %w", err)
+	}
+
+	desiredIngress := buildCanaryIngress(req)
+	ingress.Spec = desiredIngress.Spec
+	for key, value := range desiredIngress.Annotations {
+		metav1.SetMetaDataAnnotation(&ingress.ObjectMeta, key, value)
+	}
+	fmt.Println("Updating canary ingress...")
+	_, err = clientset.NetworkingV1().Ingresses(namespace).Update(context.TODO(), ingress, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("error updating canary ingress: %w", err)
+	}
+
+	return nil
+}
+
+// checkReleaseOf makes sure the live object named like a release object of
+// appName was created for a release of it, so a release never takes over an
+// object of another app.
+func checkReleaseOf(meta metav1.ObjectMeta, appName string) error {
+	if meta.Labels[releaseOfLabel] != appName {
+		return fmt.Errorf("%w: %s", errReleaseNameTaken, meta.Name)
+	}
+	return nil
+}
+
+func createRelease(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest, release *appsv1.Deployment) error {
+	tx := newTransaction(clientset, namespace)
+
+	err := tx.do("deployment", release.Name, func() error {
+		fmt.Println("Creating release...")
+		_, err := clientset.AppsV1().Deployments(namespace).Create(context.TODO(), release, metav1.CreateOptions{})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if releaseStrategy(req) != releaseCanary {
+		return nil
+	}
+
+	service := buildCanaryService(req)
+	err = tx.do("service", service.Name, func() error {
+		fmt.Println("Creating canary service...")
+		_, err := clientset.CoreV1().Services(namespace).Create(context.TODO(), service, metav1.CreateOptions{})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	ingress := buildCanaryIngress(req)
+	return tx.do("ingress", ingress.Name, func() error {
+		fmt.Println("Creating canary ingress...")
+		_, err := clientset.NetworkingV1().Ingresses(namespace).Create(context.TODO(), ingress, metav1.CreateOptions{})
+		return err
+	})
+}
+
+// promoteRelease makes the release of appName the stable version of the
+// app and returns its strategy. A canary is promoted right away by rolling
+// the stable Deployment out to it. A blue/green release first takes over
+// the traffic once all of its pods are available, and is removed in the
+// background after the stable Deployment has caught up with it.
+func promoteRelease(clientset *kubernetes.Clientset, namespace string, appName string) (string, error) {
+	release, err := getRelease(clientset, namespace, appName)
+	if err != nil {
+		return "", err
+	}
+	if release == nil {
+		return "", errNoRelease
+	}
+	strategy := release.Labels[releaseStrategyLabel]
+
+	if strategy == releaseBlueGreen {
+		if !deploymentRolledOut(release) {
+			return "", errReleaseNotReady
+		}
+		err = routeService(clientset, namespace, appName, release.Name)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	template := release.Spec.Template.DeepCopy()
+	template.Labels = map[string]string{
+		"app": appName,
+	}
+	pinSnapshotRefs(template, appName, false)
+
+	err = restoreConfig(clientset, namespace, appName, template)
+	if err != nil {
+		return "", err
+	}
+
+	deploymentsClient := clientset.AppsV1().Deployments(namespace)
+	stable, err := deploymentsClient.Get(context.TODO(), appName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("deployment not found: %w", err)
+	}
+	stable.Spec.Template = *template
+	metav1.SetMetaDataAnnotation(&stable.ObjectMeta, changeCauseAnnotation, release.Annotations[changeCauseAnnotation])
+
+	fmt.Println("Promoting release...")
+	_, err = deploymentsClient.Update(context.TODO(), stable, metav1.UpdateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("error updating deployment: %w", err)
+	}
+
+	if strategy == releaseBlueGreen {
+		go finishBlueGreenRelease(clientset, namespace, appName)
+		return strategy, nil
+	}
+
+	return strategy, removeRelease(clientset, namespace, appName, release)
+}
+
+// finishBlueGreenRelease hands the traffic back to the stable Deployment of
+// appName once it runs the promoted version and removes the release. If
+// the rollout does not finish in time the release keeps serving, and
+// promoting it again resumes from here.
+func finishBlueGreenRelease(clientset *kubernetes.Clientset, namespace string, appName string) {
+	deploymentsClient := clientset.AppsV1().Deployments(namespace)
+	err := wait.PollUntilContextTimeout(context.TODO(), 5*time.Second, releaseRolloutTimeout, true, func(ctx context.Context) (bool, error) {
+		stable, err := deploymentsClient.Get(ctx, appName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return deploymentRolledOut(stable), nil
+	})
+	if err != nil {
+		fmt.Printf("Error finishing release of %s: %v\n", appName, err)
+		return
+	}
+
+	err = routeService(clientset, namespace, appName, appName)
+	if err != nil {
+		fmt.Printf("Error finishing release of %s: %v\n", appName, err)
+		return
+	}
+
+	release, err := getRelease(clientset, namespace, appName)
+	if err == nil && release != nil {
+		err = removeRelease(clientset, namespace, appName, release)
+	}
+	if err != nil {
+		fmt.Printf("Error finishing release of %s: %v\n", appName, err)
+	}
+}
+
+// abortRelease removes the release of appName, leaving the stable version
+// as it is. A blue/green release cannot be aborted once it serves traffic.
+func abortRelease(clientset *kubernetes.Clientset, namespace string, appName string) error {
+	release, err := getRelease(clientset, namespace, appName)
+	if err != nil {
+		return err
+	}
+	if release == nil {
+		return errNoRelease
+	}
+
+	promoting, err := servesRelease(clientset, namespace, appName)
+	if err != nil {
+		return err
+	}
+	if promoting {
+		return errReleasePromoting
+	}
+
+	fmt.Println("Aborting release...")
+	return removeRelease(clientset, namespace, appName, release)
+}
+
+// removeRelease deletes the objects of release and the snapshots only it
+// referenced.
+func removeRelease(clientset *kubernetes.Clientset, namespace string, appName string, release *appsv1.Deployment) error {
+	objects := []createdObject{
+		{kind: "deployment", name: release.Name},
+	}
+	if release.Labels[releaseStrategyLabel] == releaseCanary {
+		objects = append(objects,
+			createdObject{kind: "ingress", name: ingressName(release.Name)},
+			createdObject{kind: "service", name: serviceName(release.Name)},
+		)
+	}
+	for _, object := range objects {
+		err := deleteObject(clientset, namespace, object.kind, object.name)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return pruneSnapshots(clientset, namespace, appName)
+}
+
+// routeService points the service of appName at the pods labelled with app
+// target.
+func routeService(clientset *kubernetes.Clientset, namespace string, appName string, target string) error {
+	servicesClient := clientset.CoreV1().Services(namespace)
+	service, err := servicesClient.Get(context.TODO(), serviceName(appName), metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("error fetching service: %w", err)
+	}
+	if service.Spec.Selector["app"] == target {
+		return nil
+	}
+	service.Spec.Selector = map[string]string{
+		"app": target,
+	}
+
+	fmt.Printf("Routing service to %s...\n", target)
+	_, err = servicesClient.Update(context.TODO(), service, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("error updating service: %w", err)
+	}
+
+	return nil
+}
+
+// deploymentRolledOut reports whether every replica of deployment runs its
+// current template and is available.
+func deploymentRolledOut(deployment *appsv1.Deployment) bool {
+	replicas := *deployment.Spec.Replicas
+	status := deployment.Status
+	return status.ObservedGeneration >= deployment.Generation &&
+		status.UpdatedReplicas == replicas &&
+		status.Replicas == replicas &&
+		status.AvailableReplicas == replicas
+}
+
+// getReleaseInfo describes the release of appName in progress, or returns
+// nil if there is none.
+func getReleaseInfo(clientset *kubernetes.Clientset, namespace string, appName string) (*ReleaseInfo, error) {
+	release, err := getRelease(clientset, namespace, appName)
+	if err != nil || release == nil {
+		return nil, err
+	}
+
+	info := &ReleaseInfo{
+		Strategy:       release.Labels[releaseStrategyLabel],
+		DeploymentName: release.Name,
+		Replicas:       *release.Spec.Replicas,
+		ReadyReplicas:  release.Status.ReadyReplicas,
+		ChangeCause:    release.Annotations[changeCauseAnnotation],
+	}
+	info.Image, info.ImageTag, info.ImageDigest = templateImage(appName, &release.Spec.Template)
+
+	switch info.Strategy {
+	case releaseCanary:
+		ingress, err := clientset.NetworkingV1().Ingresses(namespace).Get(context.TODO(), ingressName(release.Name), metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("error fetching canary ingress: %v", err)
+		}
+		if err == nil {
+			weight, _ := strconv.ParseInt(ingress.Annotations[nginxCanaryWeightAnnotation], 10, 32)
+			info.CanaryWeight = int32(weight)
+		}
+	case releaseBlueGreen:
+		info.Promoting, err = servesRelease(clientset, namespace, appName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return info, nil
+}
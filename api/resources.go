@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// resourcePresets are the named sizes a request can pick instead of listing
+// its requests and limits. RESOURCE_PRESETS replaces them with a JSON object
+// of the same shape, e.g. {"small":{"cpu":"100m","cpuLimit":"250m"}}.
+var resourcePresets = map[string]ResourceRequest{
+	"small": {
+		CPU:      "100m",
+		RAM:      "128Mi",
+		CPULimit: "250m",
+		RAMLimit: "256Mi",
+	},
+	"medium": {
+		CPU:      "250m",
+		RAM:      "256Mi",
+		CPULimit: "500m",
+		RAMLimit: "512Mi",
+	},
+	"large": {
+		CPU:      "500m",
+		RAM:      "512Mi",
+		CPULimit: "1",
+		RAMLimit: "1Gi",
+	},
+}
+
+// loadResourcePresets overrides the built-in presets from the environment.
+func loadResourcePresets() error {
+	value := os.Getenv("RESOURCE_PRESETS")
+	if value == "" {
+		return nil
+	}
+
+	presets := make(map[string]ResourceRequest)
+	if err := json.Unmarshal([]byte(value), &presets); err != nil {
+		return fmt.Errorf("invalid RESOURCE_PRESETS: %v", err)
+	}
+	for name, preset := range presets {
+		if preset.Preset != "" || preset.Disk != "" {
+			return fmt.Errorf("invalid RESOURCE_PRESETS: preset %s may only set cpu, ram and their limits", name)
+		}
+	}
+
+	resourcePresets = presets
+	return nil
+}
+
+func presetNames() []string {
+	names := make([]string, 0, len(resourcePresets))
+	for name := range resourcePresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// expandResourcePreset fills the requests and limits of resources that were
+// not given explicitly from its preset. Unknown presets are left for the
+// validation to report.
+func expandResourcePreset(resources *ResourceRequest) {
+	preset, ok := resourcePresets[resources.Preset]
+	if !ok {
+		return
+	}
+
+	fields := []struct {
+		value  *string
+		preset string
+	}{
+		{&resources.CPU, preset.CPU},
+		{&resources.RAM, preset.RAM},
+		{&resources.CPULimit, preset.CPULimit},
+		{&resources.RAMLimit, preset.RAMLimit},
+	}
+	for _, f := range fields {
+		if *f.value == "" {
+			*f.value = f.preset
+		}
+	}
+}
+
+// resourceRequirements builds the requests and limits of a container,
+// leaving out the resources that were not asked for so namespace defaults
+// apply to them.
+func resourceRequirements(resources *ResourceRequest) corev1.ResourceRequirements {
+	requirements := corev1.ResourceRequirements{
+		Requests: resourceRequests(resources),
+	}
+
+	limits := corev1.ResourceList{}
+	if resources.CPULimit != "" {
+		limits[corev1.ResourceCPU] = resourceQuantity(resources.CPULimit)
+	}
+	if resources.RAMLimit != "" {
+		limits[corev1.ResourceMemory] = resourceQuantity(resources.RAMLimit)
+	}
+	if len(limits) > 0 {
+		requirements.Limits = limits
+	}
+
+	return requirements
+}
+
+// appQOSClass returns the QoS class of the pods of an app. Running pods
+// report the class Kubernetes assigned them, including namespace defaults,
+// otherwise it is derived from the pod template.
+func appQOSClass(podStatuses []PodStatus, template *corev1.PodTemplateSpec) string {
+	for _, podStatus := range podStatuses {
+		if podStatus.QOSClass != "" {
+			return podStatus.QOSClass
+		}
+	}
+	return string(templateQOSClass(template))
+}
+
+// templateQOSClass follows the rules Kubernetes uses to classify pods:
+// Guaranteed when every container limits CPU and memory to its requests,
+// BestEffort when no container requests or limits anything, and Burstable
+// otherwise.
+func templateQOSClass(template *corev1.PodTemplateSpec) corev1.PodQOSClass {
+	containers := append([]corev1.Container{}, template.Spec.InitContainers...)
+	containers = append(containers, template.Spec.Containers...)
+
+	bestEffort := true
+	guaranteed := true
+	for _, container := range containers {
+		requests := container.Resources.Requests
+		limits := container.Resources.Limits
+		if len(requests) > 0 || len(limits) > 0 {
+			bestEffort = false
+		}
+
+		for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+			limit, ok := limits[name]
+			if !ok {
+				guaranteed = false
+				continue
+			}
+			// a missing request defaults to the limit
+			if request, ok := requests[name]; ok && request.Cmp(limit) != 0 {
+				guaranteed = false
+			}
+		}
+	}
+
+	switch {
+	case bestEffort:
+		return corev1.PodQOSBestEffort
+	case guaranteed:
+		return corev1.PodQOSGuaranteed
+	default:
+		return corev1.PodQOSBurstable
+	}
+}
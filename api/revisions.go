@@ -0,0 +1,489 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	revisionAnnotation    = "deployment.kubernetes.io/revision"
+	changeCauseAnnotation = "kubernetes.io/change-cause"
+	snapshotOfLabel       = "kaasapi/snapshot-of"
+)
+
+// Every distinct set of envs and secrets an app runs with is kept in an
+// immutable snapshot named after its config hash, so a rollback can bring
+// back the configuration that was in effect at the chosen revision.
+func configSnapshotName(appName string, hash string) string {
+	return configMapName(appName) + "-" + hash
+}
+
+func secretSnapshotName(appName string, hash string) string {
+	return secretName(appName) + "-" + hash
+}
+
+func snapshotLabels(appName string, hash string) map[string]string {
+	return map[string]string{
+		snapshotOfLabel:      appName,
+		configHashAnnotation: hash,
+	}
+}
+
+func createConfigSnapshot(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	hash := configHash(req)
+	immutable := true
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   configSnapshotName(req.AppName, hash),
+			Labels: snapshotLabels(req.AppName, hash),
+		},
+		Data:      keyValueMap(req.Envs),
+		Immutable: &immutable,
+	}
+
+	_, err := clientset.CoreV1().ConfigMaps(namespace).Create(context.TODO(), configMap, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("error creating config snapshot: %w", err)
+	}
+
+	return nil
+}
+
+func createSecretSnapshot(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	hash := configHash(req)
+	immutable := true
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   secretSnapshotName(req.AppName, hash),
+			Labels: snapshotLabels(req.AppName, hash),
+		},
+		StringData: keyValueMap(req.Secrets),
+		Immutable:  &immutable,
+	}
+
+	_, err := clientset.CoreV1().Secrets(namespace).Create(context.TODO(), secret, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return fmt.Errorf("error creating secret snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// snapshotConfig stores the envs and secrets of req as snapshots, if any.
+func snapshotConfig(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	if len(req.Envs) > 0 {
+		err := createConfigSnapshot(clientset, namespace, req)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(req.Secrets) > 0 {
+		err := createSecretSnapshot(clientset, namespace, req)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func changeCause(req *DeploymentRequest) string {
+	if req.ChangeCause != "" {
+		return req.ChangeCause
+	}
+	if req.ImageDigest != "" {
+		return fmt.Sprintf("deploy %s:%s@%s", req.ImageAddress, req.ImageTag, req.ImageDigest)
+	}
+	return fmt.Sprintf("deploy %s:%s", req.ImageAddress, req.ImageTag)
+}
+
+// deploymentReplicaSets returns the ReplicaSets controlled by deployment,
+// newest revision first.
+func deploymentReplicaSets(clientset *kubernetes.Clientset, deployment *appsv1.Deployment) ([]appsv1.ReplicaSet, error) {
+	selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing deployment selector: %w", err)
+	}
+
+	rsList, err := clientset.AppsV1().ReplicaSets(deployment.Namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing replicasets: %w", err)
+	}
+
+	replicaSets := make([]appsv1.ReplicaSet, 0)
+	for _, rs := range rsList.Items {
+		owner := metav1.GetControllerOf(&rs)
+		if owner != nil && owner.UID == deployment.UID {
+			replicaSets = append(replicaSets, rs)
+		}
+	}
+
+	sort.Slice(replicaSets, func(i, j int) bool {
+		return replicaSetRevision(&replicaSets[i]) > replicaSetRevision(&replicaSets[j])
+	})
+
+	return replicaSets, nil
+}
+
+func replicaSetRevision(rs *appsv1.ReplicaSet) int64 {
+	revision, _ := strconv.ParseInt(rs.Annotations[revisionAnnotation], 10, 64)
+	return revision
+}
+
+func appContainer(appName string, template *corev1.PodTemplateSpec) *corev1.Container {
+	for i := range template.Spec.Containers {
+		if template.Spec.Containers[i].Name == appName {
+			return &template.Spec.Containers[i]
+		}
+	}
+	if len(template.Spec.Containers) > 0 {
+		return &template.Spec.Containers[0]
+	}
+	return nil
+}
+
+func getRevisions(clientset *kubernetes.Clientset, namespace string, appName string) ([]DeploymentRevision, error) {
+	deployment, err := clientset.AppsV1().Deployments(namespace).Get(context.TODO(), appName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("deployment not found: %w", err)
+	}
+
+	replicaSets, err := deploymentReplicaSets(clientset, deployment)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := make([]DeploymentRevision, 0)
+	for _, rs := range replicaSets {
+		revision := DeploymentRevision{
+			Revision:    replicaSetRevision(&rs),
+			ConfigHash:  rs.Spec.Template.Annotations[configHashAnnotation],
+			ChangeCause: rs.Annotations[changeCauseAnnotation],
+			CreatedAt:   rs.CreationTimestamp,
+			Replicas:    rs.Status.Replicas,
+			Current:     rs.Annotations[revisionAnnotation] == deployment.Annotations[revisionAnnotation],
+		}
+		revision.Image, revision.ImageTag, revision.ImageDigest = templateImage(appName, &rs.Spec.Template)
+		revisions = append(revisions, revision)
+	}
+
+	return revisions, nil
+}
+
+// rollbackDeployment rolls the app back to revision, or to the one before
+// the current revision when revision is 0. The envs and secrets that were in
+// effect at that revision are restored from their snapshots before the pod
+// template is, so the rolled back pods start with the matching config.
+func rollbackDeployment(clientset *kubernetes.Clientset, namespace string, appName string, revision int64) (*DeploymentRevision, error) {
+	deploymentsClient := clientset.AppsV1().Deployments(namespace)
+	deployment, err := deploymentsClient.Get(context.TODO(), appName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("deployment not found: %w", err)
+	}
+
+	replicaSets, err := deploymentReplicaSets(clientset, deployment)
+	if err != nil {
+		return nil, err
+	}
+
+	current, _ := strconv.ParseInt(deployment.Annotations[revisionAnnotation], 10, 64)
+	var target *appsv1.ReplicaSet
+	for i := range replicaSets {
+		rsRevision := replicaSetRevision(&replicaSets[i])
+		if (revision == 0 && rsRevision < current) || (revision != 0 && rsRevision == revision) {
+			target = &replicaSets[i]
+			break
+		}
+	}
+	if target == nil {
+		return nil, fmt.Errorf("revision %d not found", revision)
+	}
+	if replicaSetRevision(target) == current {
+		return nil, fmt.Errorf("deployment is already at revision %d", current)
+	}
+
+	template := target.Spec.Template.DeepCopy()
+	delete(template.Labels, appsv1.DefaultDeploymentUniqueLabelKey)
+
+	// the config is restored before the pods roll out, and put back when
+	// the rollback fails so it keeps matching the pods that stay
+	previous, err := liveConfig(clientset, namespace, appName)
+	if err != nil {
+		return nil, err
+	}
+	err = restoreConfig(clientset, namespace, appName, template)
+	if err != nil {
+		putBackConfig(clientset, namespace, previous)
+		return nil, err
+	}
+
+	deployment.Spec.Template = *template
+	metav1.SetMetaDataAnnotation(&deployment.ObjectMeta, changeCauseAnnotation, fmt.Sprintf("rollback to revision %d", replicaSetRevision(target)))
+
+	fmt.Println("Rolling back deployment...")
+	_, err = deploymentsClient.Update(context.TODO(), deployment, metav1.UpdateOptions{})
+	if err != nil {
+		putBackConfig(clientset, namespace, previous)
+		return nil, fmt.Errorf("error rolling back deployment: %w", err)
+	}
+
+	err = pruneSnapshots(clientset, namespace, appName)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &DeploymentRevision{
+		Revision:    replicaSetRevision(target),
+		ConfigHash:  template.Annotations[configHashAnnotation],
+		ChangeCause: target.Annotations[changeCauseAnnotation],
+		CreatedAt:   target.CreationTimestamp,
+	}
+	result.Image, result.ImageTag, result.ImageDigest = templateImage(appName, template)
+
+	return result, nil
+}
+
+// restoreConfig copies the snapshots referenced by template back into the
+// live config map and secret of the app. Templates created before snapshots
+// existed carry no config hash and are rolled back without touching config.
+func restoreConfig(clientset *kubernetes.Clientset, namespace string, appName string, template *corev1.PodTemplateSpec) error {
+	hash := template.Annotations[configHashAnnotation]
+	if hash == "" {
+		return nil
+	}
+
+	usesConfig, usesSecret := false, false
+	for _, container := range template.Spec.Containers {
+		for _, envFrom := range container.EnvFrom {
+			if envFrom.ConfigMapRef != nil && envFrom.ConfigMapRef.Name == configMapName(appName) {
+				usesConfig = true
+			}
+			if envFrom.SecretRef != nil && envFrom.SecretRef.Name == secretName(appName) {
+				usesSecret = true
+			}
+		}
+	}
+
+	req := &DeploymentRequest{AppName: appName}
+
+	if usesConfig {
+		snapshot, err := clientset.CoreV1().ConfigMaps(namespace).Get(context.TODO(), configSnapshotName(appName, hash), metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("error fetching config snapshot: %w", err)
+		}
+		for k, v := range snapshot.Data {
+			req.Envs = append(req.Envs, KeyValuePair{Key: k, Value: v})
+		}
+	}
+
+	if usesSecret {
+		snapshot, err := clientset.CoreV1().Secrets(namespace).Get(context.TODO(), secretSnapshotName(appName, hash), metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("error fetching secret snapshot: %w", err)
+		}
+		for k, v := range snapshot.Data {
+			req.Secrets = append(req.Secrets, KeyValuePair{Key: k, Value: string(v)})
+		}
+	}
+
+	err := reconcileConfigMap(clientset, namespace, req)
+	if err != nil {
+		return err
+	}
+
+	return reconcileSecret(clientset, namespace, req)
+}
+
+// liveConfig returns the envs and secrets appName currently runs with.
+func liveConfig(clientset *kubernetes.Clientset, namespace string, appName string) (*DeploymentRequest, error) {
+	req := &DeploymentRequest{AppName: appName}
+
+	configMap, err := clientset.CoreV1().ConfigMaps(namespace).Get(context.TODO(), configMapName(appName), metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("error fetching config map: %w", err)
+	}
+	if err == nil {
+		for k, v := range configMap.Data {
+			req.Envs = append(req.Envs, KeyValuePair{Key: k, Value: v})
+		}
+	}
+
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(context.TODO(), secretName(appName), metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("error fetching secret: %w", err)
+	}
+	if err == nil {
+		for k, v := range secret.Data {
+			req.Secrets = append(req.Secrets, KeyValuePair{Key: k, Value: string(v)})
+		}
+	}
+
+	return req, nil
+}
+
+// putBackConfig puts the config returned by liveConfig back after a failed
+// rollback. Errors are only logged, the failure of the rollback is what the
+// caller gets to see.
+func putBackConfig(clientset *kubernetes.Clientset, namespace string, previous *DeploymentRequest) {
+	fmt.Println("Restoring config...")
+	err := reconcileConfigMap(clientset, namespace, previous)
+	if err == nil {
+		err = reconcileSecret(clientset, namespace, previous)
+	}
+	if err != nil {
+		fmt.Printf("Error restoring config of %s: %v\n", previous.AppName, err)
+	}
+}
+
+// pruneSnapshots deletes the snapshots of appName that are no longer
+// referenced by its workload or any revision it retains.
+func pruneSnapshots(clientset *kubernetes.Clientset, namespace string, appName string) error {
+	kind, err := liveWorkloadKind(clientset, namespace, appName)
+	if err != nil {
+		return err
+	}
+
+	var referenced map[string]bool
+	if kind == "statefulset" {
+		referenced, err = statefulSetConfigHashes(clientset, namespace, appName)
+	} else {
+		referenced, err = deploymentConfigHashes(clientset, namespace, appName)
+	}
+	if err != nil {
+		return err
+	}
+
+	release, err := getRelease(clientset, namespace, appName)
+	if err != nil {
+		return err
+	}
+	if release != nil {
+		referenced[release.Spec.Template.Annotations[configHashAnnotation]] = true
+	}
+
+	snapshots, err := listSnapshots(clientset, namespace, appName)
+	if err != nil {
+		return err
+	}
+	for _, snapshot := range snapshots {
+		if referenced[snapshot.hash] {
+			continue
+		}
+		err = deleteObject(clientset, namespace, snapshot.kind, snapshot.name)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deploymentConfigHashes returns the config hashes of the Deployment of
+// appName and of its retained ReplicaSets.
+func deploymentConfigHashes(clientset *kubernetes.Clientset, namespace string, appName string) (map[string]bool, error) {
+	deployment, err := clientset.AppsV1().Deployments(namespace).Get(context.TODO(), appName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching deployment: %w", err)
+	}
+
+	replicaSets, err := deploymentReplicaSets(clientset, deployment)
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := map[string]bool{
+		deployment.Spec.Template.Annotations[configHashAnnotation]: true,
+	}
+	for _, rs := range replicaSets {
+		hashes[rs.Spec.Template.Annotations[configHashAnnotation]] = true
+	}
+	return hashes, nil
+}
+
+// statefulSetConfigHashes returns the config hashes of the StatefulSet of
+// appName and of the ControllerRevisions it retains, whose data is a patch
+// replacing the pod template.
+func statefulSetConfigHashes(clientset *kubernetes.Clientset, namespace string, appName string) (map[string]bool, error) {
+	statefulSet, err := clientset.AppsV1().StatefulSets(namespace).Get(context.TODO(), appName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching statefulset: %w", err)
+	}
+	selector, err := metav1.LabelSelectorAsSelector(statefulSet.Spec.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing statefulset selector: %w", err)
+	}
+	revisionList, err := clientset.AppsV1().ControllerRevisions(namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing controller revisions: %w", err)
+	}
+
+	hashes := map[string]bool{
+		statefulSet.Spec.Template.Annotations[configHashAnnotation]: true,
+	}
+	for _, revision := range revisionList.Items {
+		owner := metav1.GetControllerOf(&revision)
+		if owner == nil || owner.UID != statefulSet.UID {
+			continue
+		}
+		var patch struct {
+			Spec struct {
+				Template corev1.PodTemplateSpec `json:"template"`
+			} `json:"spec"`
+		}
+		if err := json.Unmarshal(revision.Data.Raw, &patch); err != nil {
+			return nil, fmt.Errorf("error decoding controller revision %s: %v", revision.Name, err)
+		}
+		hashes[patch.Spec.Template.Annotations[configHashAnnotation]] = true
+	}
+	return hashes, nil
+}
+
+type snapshotObject struct {
+	createdObject
+	hash string
+}
+
+func listSnapshots(clientset *kubernetes.Clientset, namespace string, appName string) ([]snapshotObject, error) {
+	listOptions := metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", snapshotOfLabel, appName),
+	}
+
+	configMapList, err := clientset.CoreV1().ConfigMaps(namespace).List(context.TODO(), listOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error listing config snapshots: %w", err)
+	}
+	secretList, err := clientset.CoreV1().Secrets(namespace).List(context.TODO(), listOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error listing secret snapshots: %w", err)
+	}
+
+	snapshots := make([]snapshotObject, 0)
+	for _, configMap := range configMapList.Items {
+		snapshots = append(snapshots, snapshotObject{
+			createdObject: createdObject{kind: "configmap", name: configMap.Name},
+			hash:          configMap.Labels[configHashAnnotation],
+		})
+	}
+	for _, secret := range secretList.Items {
+		snapshots = append(snapshots, snapshotObject{
+			createdObject: createdObject{kind: "secret", name: secret.Name},
+			hash:          secret.Labels[configHashAnnotation],
+		})
+	}
+
+	return snapshots, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// configTemplate is the pod template of app web running with the config
+// snapshot hash.
+func configTemplate(hash string) corev1.PodTemplateSpec {
+	return corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:      map[string]string{"app": "web"},
+			Annotations: map[string]string{configHashAnnotation: hash},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name:  "web",
+				Image: "nginx:" + hash,
+				EnvFrom: []corev1.EnvFromSource{{
+					ConfigMapRef: &corev1.ConfigMapEnvSource{
+						LocalObjectReference: corev1.LocalObjectReference{Name: configMapName("web")},
+					},
+				}},
+			}},
+		},
+	}
+}
+
+func TestRollbackDeploymentFailureKeepsConfig(t *testing.T) {
+	deployment := appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "team",
+			UID:         "web-uid",
+			Annotations: map[string]string{revisionAnnotation: "2"},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+			Template: configTemplate("new"),
+		},
+	}
+	replicaSet := func(revision string, hash string) appsv1.ReplicaSet {
+		return appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            "web-" + hash,
+				Namespace:       "team",
+				Annotations:     map[string]string{revisionAnnotation: revision},
+				OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(&deployment, appsv1.SchemeGroupVersion.WithKind("Deployment"))},
+			},
+			Spec: appsv1.ReplicaSetSpec{Template: configTemplate(hash)},
+		}
+	}
+	liveData := map[string]string{"GREETING": "new"}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		reply := func(obj interface{}) {
+			json.NewEncoder(w).Encode(obj)
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "GET /apis/apps/v1/namespaces/team/deployments/web":
+			reply(deployment)
+		case "GET /apis/apps/v1/namespaces/team/replicasets":
+			reply(appsv1.ReplicaSetList{Items: []appsv1.ReplicaSet{replicaSet("2", "new"), replicaSet("1", "old")}})
+		case "GET /api/v1/namespaces/team/configmaps/web-config":
+			reply(corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "web-config"}, Data: maps.Clone(liveData)})
+		case "PUT /api/v1/namespaces/team/configmaps/web-config":
+			var configMap corev1.ConfigMap
+			json.NewDecoder(r.Body).Decode(&configMap)
+			liveData = configMap.Data
+			reply(configMap)
+		case "GET /api/v1/namespaces/team/configmaps/" + configSnapshotName("web", "old"):
+			reply(corev1.ConfigMap{Data: map[string]string{"GREETING": "old"}})
+		case "PUT /apis/apps/v1/namespaces/team/deployments/web":
+			w.WriteHeader(http.StatusConflict)
+			reply(metav1.Status{Status: metav1.StatusFailure, Reason: metav1.StatusReasonConflict, Code: http.StatusConflict})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			reply(metav1.Status{Status: metav1.StatusFailure, Reason: metav1.StatusReasonNotFound, Code: http.StatusNotFound})
+		}
+	}))
+	t.Cleanup(server.Close)
+	clientset, err := kubernetes.NewForConfig(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rollbackDeployment(clientset, "team", "web", 1); err == nil {
+		t.Fatal("rollback succeeded although the deployment could not be updated")
+	}
+	if liveData["GREETING"] != "new" {
+		t.Errorf("config = %v, want the config the pods still run with", liveData)
+	}
+}
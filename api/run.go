@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	runOfLabel = "kaasapi/run-of"
+
+	defaultRunTimeoutSeconds = 3600
+	runTTLSeconds            = 3600
+
+	// runStartTimeout bounds the wait for the image to be pulled and the
+	// command to start.
+	runStartTimeout = 5 * time.Minute
+)
+
+// runStartFailures are the reasons a container waits with that will not go
+// away by waiting longer.
+var runStartFailures = []string{
+	"ErrImagePull",
+	"ImagePullBackOff",
+	"InvalidImageName",
+	"CreateContainerConfigError",
+	"CreateContainerError",
+}
+
+// errRunTimedOut is returned when a run outlives its timeout and is killed.
+var errRunTimedOut = errors.New("run timed out")
+
+// liveTemplate returns the pod template of the running app, whichever kind
+// of workload it is.
+func liveTemplate(clientset *kubernetes.Clientset, namespace string, appName string) (*corev1.PodTemplateSpec, error) {
+	kind, err := liveWorkloadKind(clientset, namespace, appName)
+	if err != nil {
+		return nil, err
+	}
+
+	if kind == "statefulset" {
+		statefulSet, err := clientset.AppsV1().StatefulSets(namespace).Get(context.TODO(), appName, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("error fetching statefulset: %w", err)
+		}
+		return &statefulSet.Spec.Template, nil
+	}
+	deployment, err := clientset.AppsV1().Deployments(namespace).Get(context.TODO(), appName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching deployment: %w", err)
+	}
+	return &deployment.Spec.Template, nil
+}
+
+// buildRunJob builds a job running req in a copy of the app container, with
+// the same image, env, config and secret files. The data volume is left out
+// since it can only be mounted by the app itself, and the pod is not
+// labelled with the app so its services never route to it.
+func buildRunJob(appName string, tenant string, template *corev1.PodTemplateSpec, req *RunRequest) (*batchv1.Job, error) {
+	source := appContainer(appName, template)
+	if source == nil {
+		return nil, fmt.Errorf("app %s has no container", appName)
+	}
+
+	var volumes []corev1.Volume
+	for _, volume := range template.Spec.Volumes {
+		if volume.PersistentVolumeClaim == nil {
+			volumes = append(volumes, volume)
+		}
+	}
+	var mounts []corev1.VolumeMount
+	for _, mount := range source.VolumeMounts {
+		if slices.ContainsFunc(volumes, func(volume corev1.Volume) bool { return volume.Name == mount.Name }) {
+			mounts = append(mounts, mount)
+		}
+	}
+
+	timeout := int64(defaultRunTimeoutSeconds)
+	if req.TimeoutSeconds != nil {
+		timeout = *req.TimeoutSeconds
+	}
+	backoffLimit := int32(0)
+	ttl := int32(runTTLSeconds)
+	runLabels := map[string]string{
+		runOfLabel:  appName,
+		tenantLabel: tenant,
+	}
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: appName + "-run-",
+			Labels:       runLabels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            &backoffLimit,
+			ActiveDeadlineSeconds:   &timeout,
+			TTLSecondsAfterFinished: &ttl,
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: runLabels,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:         appName,
+							Image:        source.Image,
+							Command:      req.Command,
+							Args:         req.Args,
+							Env:          source.Env,
+							EnvFrom:      source.EnvFrom,
+							Resources:    source.Resources,
+							VolumeMounts: mounts,
+						},
+					},
+					Volumes:          volumes,
+					RestartPolicy:    corev1.RestartPolicyNever,
+					ImagePullSecrets: template.Spec.ImagePullSecrets,
+				},
+			},
+		},
+	}, nil
+}
+
+// startRun launches the job running req next to the app.
+func startRun(clientset *kubernetes.Clientset, namespace string, appName string, tenant string, req *RunRequest) (*batchv1.Job, error) {
+	template, err := liveTemplate(clientset, namespace, appName)
+	if err != nil {
+		return nil, err
+	}
+	job, err := buildRunJob(appName, tenant, template, req)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("Creating run job...")
+	job, err = clientset.BatchV1().Jobs(namespace).Create(context.TODO(), job, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error creating run job: %w", err)
+	}
+
+	return job, nil
+}
+
+// streamRun waits for the pod of a run job to start, writes every line it
+// logs to emit and returns the exit code of the command. The job is deleted
+// when ctx is cancelled before the command exits, like a detached terminal
+// ends its session.
+func streamRun(ctx context.Context, clientset *kubernetes.Clientset, namespace string, appName string, job *batchv1.Job, emit func(RunEvent) error) (int32, error) {
+	pod, err := waitForRunPod(ctx, clientset, namespace, appName, job.Name)
+	if err != nil {
+		// a run that cannot start would otherwise keep pulling its image
+		// until its deadline
+		deleteRunJob(clientset, namespace, job.Name)
+		return 0, err
+	}
+
+	stream, err := clientset.CoreV1().Pods(namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Container: appName,
+		Follow:    true,
+	}).Stream(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error streaming run output: %v", err)
+	}
+	defer stream.Close()
+
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if err := emit(RunEvent{Log: scanner.Text()}); err != nil {
+			deleteRunJob(clientset, namespace, job.Name)
+			return 0, err
+		}
+	}
+	if ctx.Err() != nil {
+		deleteRunJob(clientset, namespace, job.Name)
+		return 0, ctx.Err()
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("error reading run output: %v", err)
+	}
+
+	return runExitCode(ctx, clientset, namespace, appName, job.Name, pod.Name)
+}
+
+// waitForRunPod waits until the command of a run job has started, failing
+// early when its container cannot be created.
+func waitForRunPod(ctx context.Context, clientset *kubernetes.Clientset, namespace string, appName string, jobName string) (*corev1.Pod, error) {
+	selector := labels.SelectorFromSet(labels.Set{jobNameLabel: jobName}).String()
+	var started *corev1.Pod
+	err := wait.PollUntilContextTimeout(ctx, time.Second, runStartTimeout, true, func(ctx context.Context) (bool, error) {
+		pods, err := clientset.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+		if err != nil || len(pods.Items) == 0 {
+			return false, nil
+		}
+		pod := &pods.Items[0]
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			started = pod
+			return true, nil
+		}
+		status := containerStatus(appName, pod)
+		if status == nil {
+			return false, nil
+		}
+		if waiting := status.State.Waiting; waiting != nil && slices.Contains(runStartFailures, waiting.Reason) {
+			return false, fmt.Errorf("run could not start: %s: %s", waiting.Reason, waiting.Message)
+		}
+		if status.State.Running != nil || status.State.Terminated != nil {
+			started = pod
+			return true, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		if wait.Interrupted(err) && ctx.Err() == nil {
+			return nil, fmt.Errorf("run did not start within %s", runStartTimeout)
+		}
+		return nil, err
+	}
+
+	return started, nil
+}
+
+// runExitCode waits for the kubelet to report how the command of a run
+// ended, which may lag behind the end of its output.
+func runExitCode(ctx context.Context, clientset *kubernetes.Clientset, namespace string, appName string, jobName string, podName string) (int32, error) {
+	var exitCode int32
+	err := wait.PollUntilContextTimeout(ctx, time.Second, time.Minute, true, func(ctx context.Context) (bool, error) {
+		pod, err := clientset.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			// the job controller deletes the pods of jobs past their deadline
+			return false, errRunTimedOut
+		}
+		if err != nil {
+			return false, nil
+		}
+		status := containerStatus(appName, pod)
+		if status == nil || status.State.Terminated == nil {
+			return false, nil
+		}
+		exitCode = status.State.Terminated.ExitCode
+		return true, nil
+	})
+	if err != nil {
+		if errors.Is(err, errRunTimedOut) {
+			return 0, err
+		}
+		job, jobErr := clientset.BatchV1().Jobs(namespace).Get(context.TODO(), jobName, metav1.GetOptions{})
+		if jobErr == nil && jobFailedReason(job) == batchv1.JobReasonDeadlineExceeded {
+			return 0, errRunTimedOut
+		}
+		return 0, fmt.Errorf("error fetching run exit code: %v", err)
+	}
+
+	return exitCode, nil
+}
+
+func containerStatus(name string, pod *corev1.Pod) *corev1.ContainerStatus {
+	for i := range pod.Status.ContainerStatuses {
+		if pod.Status.ContainerStatuses[i].Name == name {
+			return &pod.Status.ContainerStatuses[i]
+		}
+	}
+	return nil
+}
+
+func jobFailedReason(job *batchv1.Job) string {
+	for _, condition := range job.Status.Conditions {
+		if condition.Type == batchv1.JobFailed && condition.Status == corev1.ConditionTrue {
+			return condition.Reason
+		}
+	}
+	return ""
+}
+
+func deleteRunJob(clientset *kubernetes.Clientset, namespace string, name string) {
+	fmt.Println("Deleting run job...")
+	if err := deleteObject(clientset, namespace, "job", name); err != nil && !apierrors.IsNotFound(err) {
+		fmt.Printf("Error deleting run job %s: %v\n", name, err)
+	}
+}
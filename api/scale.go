@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	autoscalingv2 "k8s.io/api/autoscaling/v2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// errAutoscaled is returned when manually scaling an app whose replicas are
+// managed by its HorizontalPodAutoscaler.
+var errAutoscaled = errors.New("app is autoscaled, change its autoscaling bounds instead")
+
+// errSharedDisk is returned when scaling out a Deployment app with a disk.
+// Its single claim can only be mounted by one pod, so the app has to be
+// redeployed with more replicas to run as a StatefulSet with a claim per pod.
+var errSharedDisk = errors.New("app has a disk that only one pod can mount, redeploy it with more replicas instead")
+
+// defaultCPUUtilization is the CPU target used when autoscaling is requested
+// without any target, matching the HPA of the API itself.
+const defaultCPUUtilization = 80
+
+func hpaName(appName string) string {
+	return appName + "-hpa"
+}
+
+// scaleApp sets the replicas of the Deployment or StatefulSet of appName
+// through its scale subresource.
+func scaleApp(clientset *kubernetes.Clientset, namespace string, appName string, replicas int32) error {
+	_, err := clientset.AutoscalingV2().HorizontalPodAutoscalers(namespace).Get(context.TODO(), hpaName(appName), metav1.GetOptions{})
+	if err == nil {
+		return errAutoscaled
+	}
+	if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error fetching autoscaler: %w", err)
+	}
+
+	deploymentsClient := clientset.AppsV1().Deployments(namespace)
+	if replicas > 1 {
+		deployment, err := deploymentsClient.Get(context.TODO(), appName, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("error fetching deployment: %w", err)
+		}
+		if err == nil && mountsDataClaim(appName, &deployment.Spec.Template) {
+			return errSharedDisk
+		}
+	}
+
+	scale, err := deploymentsClient.GetScale(context.TODO(), appName, metav1.GetOptions{})
+	if err == nil {
+		scale.Spec.Replicas = replicas
+		_, err = deploymentsClient.UpdateScale(context.TODO(), appName, scale, metav1.UpdateOptions{})
+		if err != nil {
+			return fmt.Errorf("error scaling deployment: %w", err)
+		}
+		return nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error fetching deployment scale: %w", err)
+	}
+
+	statefulSetsClient := clientset.AppsV1().StatefulSets(namespace)
+	scale, err = statefulSetsClient.GetScale(context.TODO(), appName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("app not found: %w", err)
+	}
+	scale.Spec.Replicas = replicas
+	_, err = statefulSetsClient.UpdateScale(context.TODO(), appName, scale, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("error scaling statefulset: %w", err)
+	}
+
+	return nil
+}
+
+// mountsDataClaim reports whether the pods of template mount the data claim
+// of appName.
+func mountsDataClaim(appName string, template *corev1.PodTemplateSpec) bool {
+	for _, volume := range template.Spec.Volumes {
+		if volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == dataClaimName(appName) {
+			return true
+		}
+	}
+	return false
+}
+
+func createHPA(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	hpa := buildHPA(req)
+	hpasClient := clientset.AutoscalingV2().HorizontalPodAutoscalers(namespace)
+	fmt.Println("Creating autoscaler...")
+	_, err := hpasClient.Create(context.TODO(), hpa, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func buildHPA(req *DeploymentRequest) *autoscalingv2.HorizontalPodAutoscaler {
+	autoscaling := req.Autoscaling
+
+	var metrics []autoscalingv2.MetricSpec
+	utilizationMetric := func(name corev1.ResourceName, utilization int32) autoscalingv2.MetricSpec {
+		return autoscalingv2.MetricSpec{
+			Type: autoscalingv2.ResourceMetricSourceType,
+			Resource: &autoscalingv2.ResourceMetricSource{
+				Name: name,
+				Target: autoscalingv2.MetricTarget{
+					Type:               autoscalingv2.UtilizationMetricType,
+					AverageUtilization: int32Ptr(utilization),
+				},
+			},
+		}
+	}
+	if autoscaling.CPUUtilization > 0 {
+		metrics = append(metrics, utilizationMetric(corev1.ResourceCPU, autoscaling.CPUUtilization))
+	}
+	if autoscaling.MemoryUtilization > 0 {
+		metrics = append(metrics, utilizationMetric(corev1.ResourceMemory, autoscaling.MemoryUtilization))
+	}
+	if len(metrics) == 0 {
+		metrics = append(metrics, utilizationMetric(corev1.ResourceCPU, defaultCPUUtilization))
+	}
+
+	targetKind := "Deployment"
+	if usesStatefulSet(req) {
+		targetKind = "StatefulSet"
+	}
+
+	return &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   hpaName(req.AppName),
+			Labels: appLabels(req),
+		},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{
+				APIVersion: "apps/v1",
+				Kind:       targetKind,
+				Name:       req.AppName,
+			},
+			MinReplicas: int32Ptr(minReplicas(req)),
+			MaxReplicas: autoscaling.MaxReplicas,
+			Metrics:     metrics,
+		},
+	}
+}
+
+// minReplicas is the lower autoscaling bound of req, defaulting to the
+// requested replicas.
+func minReplicas(req *DeploymentRequest) int32 {
+	if req.Autoscaling.MinReplicas > 0 {
+		return req.Autoscaling.MinReplicas
+	}
+	if req.Replicas > 0 {
+		return req.Replicas
+	}
+	return 1
+}
+
+// reconcileHPA creates or updates the autoscaler of the app when autoscaling
+// is requested and removes it otherwise.
+func reconcileHPA(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	hpasClient := clientset.AutoscalingV2().HorizontalPodAutoscalers(namespace)
+	hpa, err := hpasClient.Get(context.TODO(), hpaName(req.AppName), metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error fetching autoscaler: %w", err)
+	}
+	exists := err == nil
+
+	if req.Autoscaling == nil {
+		if !exists {
+			return nil
+		}
+		fmt.Println("Deleting autoscaler...")
+		err = hpasClient.Delete(context.TODO(), hpa.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("error deleting autoscaler: %w", err)
+		}
+		return nil
+	}
+
+	if !exists {
+		return createHPA(clientset, namespace, req)
+	}
+
+	hpa.Spec = buildHPA(req).Spec
+
+	fmt.Println("Updating autoscaler...")
+	_, err = hpasClient.Update(context.TODO(), hpa, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("error updating autoscaler: %w", err)
+	}
+
+	return nil
+}
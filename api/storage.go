@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const dataVolumeName = "data"
+
+// errWorkloadKindChanged is returned when an update would move an app
+// between a Deployment and a StatefulSet, which cannot be done in place.
+var errWorkloadKindChanged = errors.New("changing the disk or replicas would switch the app between a Deployment and a StatefulSet, delete and recreate it instead")
+
+// errDiskChanged is returned when an update would resize the disk of a
+// StatefulSet app, whose claim templates are immutable.
+var errDiskChanged = errors.New("the disk of a multi-replica app cannot be changed")
+
+func dataClaimName(appName string) string {
+	return appName + "-data"
+}
+
+// usesStatefulSet reports whether the app of req runs as a StatefulSet.
+// Apps with a disk that may run more than one pod need one claim per pod,
+// while a single pod simply mounts the claim of its Deployment.
+func usesStatefulSet(req *DeploymentRequest) bool {
+	return req.Resources.Disk != "" && (req.Replicas > 1 || req.Autoscaling != nil)
+}
+
+func workloadKind(req *DeploymentRequest) string {
+	if usesStatefulSet(req) {
+		return "statefulset"
+	}
+	return "deployment"
+}
+
+// liveWorkloadKind returns whether appName currently runs as a Deployment
+// or a StatefulSet.
+func liveWorkloadKind(clientset *kubernetes.Clientset, namespace string, appName string) (string, error) {
+	_, err := clientset.AppsV1().Deployments(namespace).Get(context.TODO(), appName, metav1.GetOptions{})
+	if err == nil {
+		return "deployment", nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return "", fmt.Errorf("error fetching deployment: %w", err)
+	}
+
+	_, err = clientset.AppsV1().StatefulSets(namespace).Get(context.TODO(), appName, metav1.GetOptions{})
+	if err == nil {
+		return "statefulset", nil
+	}
+	return "", fmt.Errorf("app not found: %w", err)
+}
+
+func buildDataClaim(req *DeploymentRequest) *corev1.PersistentVolumeClaim {
+	claim := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   dataClaimName(req.AppName),
+			Labels: appLabels(req),
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{
+				corev1.ReadWriteOnce,
+			},
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: resourceQuantity(req.Resources.Disk),
+				},
+			},
+		},
+	}
+	if req.StorageClass != "" {
+		claim.Spec.StorageClassName = &req.StorageClass
+	}
+	return claim
+}
+
+func createDataClaim(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	claim := buildDataClaim(req)
+	fmt.Println("Creating persistent volume claim...")
+	_, err := clientset.CoreV1().PersistentVolumeClaims(namespace).Create(context.TODO(), claim, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// reconcileDataClaim creates the data claim of a Deployment app or expands
+// it when a bigger disk is requested. Claims are never shrunk, and a claim
+// that is no longer requested is retained until the app is deleted.
+func reconcileDataClaim(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	if req.Resources.Disk == "" {
+		return nil
+	}
+
+	claimsClient := clientset.CoreV1().PersistentVolumeClaims(namespace)
+	claim, err := claimsClient.Get(context.TODO(), dataClaimName(req.AppName), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return createDataClaim(clientset, namespace, req)
+	}
+	if err != nil {
+		return fmt.Errorf("error fetching persistent volume claim: %w", err)
+	}
+
+	desired := resourceQuantity(req.Resources.Disk)
+	current := claim.Spec.Resources.Requests[corev1.ResourceStorage]
+	switch desired.Cmp(current) {
+	case 0:
+		return nil
+	case -1:
+		return fmt.Errorf("disk cannot be shrunk from %s to %s", current.String(), desired.String())
+	}
+
+	claim.Spec.Resources.Requests[corev1.ResourceStorage] = desired
+
+	fmt.Println("Expanding persistent volume claim...")
+	_, err = claimsClient.Update(context.TODO(), claim, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("error expanding persistent volume claim: %w", err)
+	}
+
+	return nil
+}
+
+func buildStatefulSet(req *DeploymentRequest) *appsv1.StatefulSet {
+	claim := buildDataClaim(req)
+	claim.Name = dataVolumeName
+
+	return &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   req.AppName,
+			Labels: appLabels(req),
+			Annotations: map[string]string{
+				changeCauseAnnotation: changeCause(req),
+			},
+		},
+		Spec: appsv1.StatefulSetSpec{
+			ServiceName: serviceName(req.AppName),
+			Replicas:    int32Ptr(initialReplicas(req)),
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app": req.AppName,
+				},
+			},
+			Template:             buildPodTemplate(req),
+			VolumeClaimTemplates: []corev1.PersistentVolumeClaim{*claim},
+		},
+	}
+}
+
+func createStatefulSet(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	statefulSet := buildStatefulSet(req)
+	fmt.Println("Creating statefulset...")
+	_, err := clientset.AppsV1().StatefulSets(namespace).Create(context.TODO(), statefulSet, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// checkStatefulSetDisk makes sure req keeps the disk size of a StatefulSet
+// app. The claim templates of a StatefulSet are immutable, so this is
+// checked before anything of the app is changed.
+func checkStatefulSetDisk(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	statefulSet, err := clientset.AppsV1().StatefulSets(namespace).Get(context.TODO(), req.AppName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("statefulset not found: %w", err)
+	}
+
+	for _, template := range statefulSet.Spec.VolumeClaimTemplates {
+		if template.Name != dataVolumeName {
+			continue
+		}
+		current := template.Spec.Resources.Requests[corev1.ResourceStorage]
+		if current.Cmp(resourceQuantity(req.Resources.Disk)) != 0 {
+			return fmt.Errorf("%w: it is %s", errDiskChanged, current.String())
+		}
+	}
+
+	return nil
+}
+
+// updateStatefulSet rolls the pods of a StatefulSet app out to req. Its disk
+// has been checked by checkStatefulSetDisk.
+func updateStatefulSet(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	statefulSetsClient := clientset.AppsV1().StatefulSets(namespace)
+	statefulSet, err := statefulSetsClient.Get(context.TODO(), req.AppName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("statefulset not found: %w", err)
+	}
+
+	desired := buildStatefulSet(req)
+	if req.Autoscaling == nil {
+		statefulSet.Spec.Replicas = desired.Spec.Replicas
+	}
+	statefulSet.Spec.Template = desired.Spec.Template
+	metav1.SetMetaDataAnnotation(&statefulSet.ObjectMeta, changeCauseAnnotation, changeCause(req))
+
+	fmt.Println("Updating statefulset...")
+	_, err = statefulSetsClient.Update(context.TODO(), statefulSet, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("error updating statefulset: %w", err)
+	}
+
+	return nil
+}
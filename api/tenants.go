@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	tenantLabel      = "kaasapi/tenant"
+	namespaceKey     = "namespace"
+	tenantKey        = "tenant"
+	tenantQuotaName  = "tenant-quota"
+	tenantLimitsName = "tenant-limits"
+)
+
+// TenantConfig holds the namespace prefix and the default quota and limits
+// every tenant namespace is provisioned with, and the base domain app
+// subdomains are allocated from.
+type TenantConfig struct {
+	NamespacePrefix      string
+	QuotaCPU             string
+	QuotaMemory          string
+	QuotaStorage         string
+	QuotaPods            string
+	DefaultCPULimit      string
+	DefaultMemoryLimit   string
+	DefaultCPURequest    string
+	DefaultMemoryRequest string
+	BaseDomain           string
+}
+
+var tenantConfig = TenantConfig{
+	NamespacePrefix:      "kaas-",
+	QuotaCPU:             "8",
+	QuotaMemory:          "16Gi",
+	QuotaStorage:         "100Gi",
+	QuotaPods:            "50",
+	DefaultCPULimit:      "500m",
+	DefaultMemoryLimit:   "512Mi",
+	DefaultCPURequest:    "100m",
+	DefaultMemoryRequest: "128Mi",
+}
+
+// loadTenantConfig overrides the tenant defaults from the environment.
+func loadTenantConfig() {
+	overrides := map[string]*string{
+		"TENANT_NAMESPACE_PREFIX":       &tenantConfig.NamespacePrefix,
+		"TENANT_QUOTA_CPU":              &tenantConfig.QuotaCPU,
+		"TENANT_QUOTA_MEMORY":           &tenantConfig.QuotaMemory,
+		"TENANT_QUOTA_STORAGE":          &tenantConfig.QuotaStorage,
+		"TENANT_QUOTA_PODS":             &tenantConfig.QuotaPods,
+		"TENANT_DEFAULT_CPU_LIMIT":      &tenantConfig.DefaultCPULimit,
+		"TENANT_DEFAULT_MEMORY_LIMIT":   &tenantConfig.DefaultMemoryLimit,
+		"TENANT_DEFAULT_CPU_REQUEST":    &tenantConfig.DefaultCPURequest,
+		"TENANT_DEFAULT_MEMORY_REQUEST": &tenantConfig.DefaultMemoryRequest,
+		"BASE_DOMAIN":                   &tenantConfig.BaseDomain,
+	}
+	for env, value := range overrides {
+		if v := os.Getenv(env); v != "" {
+			*value = v
+		}
+	}
+}
+
+func tenantNamespaceName(tenant string) string {
+	return tenantConfig.NamespacePrefix + tenant
+}
+
+// provisionedTenants caches the namespaces already provisioned by this
+// replica, so only the first request of a tenant talks to the cluster.
+var provisionedTenants sync.Map
+
+// tenantMiddleware makes sure the namespace of the authenticated tenant is
+// provisioned and stores the namespace in the echo context for
+// the handlers to scope every read and write to.
+func tenantMiddleware(clientset *kubernetes.Clientset) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			tenant := tenantOf(c)
+			if errs := validation.IsDNS1123Label(tenantNamespaceName(tenant)); len(errs) > 0 {
+				return c.String(http.StatusBadRequest, fmt.Sprintf("Invalid tenant %v: %v", tenant, errs))
+			}
+
+			namespace, err := ensureTenantNamespace(clientset, tenant)
+			if err != nil {
+				return c.String(http.StatusInternalServerError, fmt.Sprintf("Error provisioning tenant namespace: %v", err))
+			}
+
+			c.Set(tenantKey, tenant)
+			c.Set(namespaceKey, namespace)
+			return next(c)
+		}
+	}
+}
+
+func tenantNamespace(c echo.Context) string {
+	return c.Get(namespaceKey).(string)
+}
+
+// ownershipMiddleware answers 404 for routes naming an app that belongs to
+// another tenant, exactly as if the app did not exist.
+func ownershipMiddleware(clientset *kubernetes.Clientset) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			appName := c.Param("appName")
+			if appName == "" {
+				return next(c)
+			}
+
+			owner, err := appOwner(clientset, tenantNamespace(c), appName)
+			if err != nil {
+				return c.String(http.StatusInternalServerError, fmt.Sprintf("Error fetching app: %v", err))
+			}
+			if owner != "" && owner != tenantOf(c) {
+				return c.String(http.StatusNotFound, fmt.Sprintf("App not found: %v", appName))
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// appOwner returns the tenant label of the Deployment or StatefulSet of
+// appName, or an empty string if the app does not exist or predates tenant
+// labels, in which case its namespace alone decides ownership.
+func appOwner(clientset *kubernetes.Clientset, namespace string, appName string) (string, error) {
+	deployment, err := clientset.AppsV1().Deployments(namespace).Get(context.TODO(), appName, metav1.GetOptions{})
+	if err == nil {
+		return deployment.Labels[tenantLabel], nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return "", err
+	}
+
+	statefulSet, err := clientset.AppsV1().StatefulSets(namespace).Get(context.TODO(), appName, metav1.GetOptions{})
+	if err == nil {
+		return statefulSet.Labels[tenantLabel], nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return "", err
+	}
+
+	return "", nil
+}
+
+// appLabels are the labels of every object generated for req, recording the
+// app and the tenant that owns it.
+func appLabels(req *DeploymentRequest) map[string]string {
+	labels := map[string]string{
+		"app": req.AppName,
+	}
+	if req.Tenant != "" {
+		labels[tenantLabel] = req.Tenant
+	}
+	return labels
+}
+
+// ensureTenantNamespace creates the namespace of tenant together with its
+// ResourceQuota and LimitRange if they do not exist yet.
+func ensureTenantNamespace(clientset *kubernetes.Clientset, tenant string) (string, error) {
+	namespace := tenantNamespaceName(tenant)
+	if _, ok := provisionedTenants.Load(tenant); ok {
+		return namespace, nil
+	}
+
+	ns := &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: namespace,
+			Labels: map[string]string{
+				tenantLabel:                    tenant,
+				"app.kubernetes.io/managed-by": fieldManager,
+			},
+		},
+	}
+	_, err := clientset.CoreV1().Namespaces().Create(context.TODO(), ns, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return "", fmt.Errorf("error creating namespace: %w", err)
+	}
+
+	quota, err := buildTenantQuota()
+	if err != nil {
+		return "", err
+	}
+	fmt.Println("Creating tenant quota...")
+	_, err = clientset.CoreV1().ResourceQuotas(namespace).Create(context.TODO(), quota, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return "", fmt.Errorf("error creating resource quota: %w", err)
+	}
+
+	limitRange, err := buildTenantLimitRange()
+	if err != nil {
+		return "", err
+	}
+	fmt.Println("Creating tenant limit range...")
+	_, err = clientset.CoreV1().LimitRanges(namespace).Create(context.TODO(), limitRange, metav1.CreateOptions{})
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		return "", fmt.Errorf("error creating limit range: %w", err)
+	}
+
+	provisionedTenants.Store(tenant, true)
+	return namespace, nil
+}
+
+func buildTenantQuota() (*corev1.ResourceQuota, error) {
+	hard, err := parseResourceList(map[corev1.ResourceName]string{
+		corev1.ResourceRequestsCPU:     tenantConfig.QuotaCPU,
+		corev1.ResourceRequestsMemory:  tenantConfig.QuotaMemory,
+		corev1.ResourceRequestsStorage: tenantConfig.QuotaStorage,
+		corev1.ResourcePods:            tenantConfig.QuotaPods,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenant quota: %w", err)
+	}
+
+	return &corev1.ResourceQuota{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: tenantQuotaName,
+		},
+		Spec: corev1.ResourceQuotaSpec{
+			Hard: hard,
+		},
+	}, nil
+}
+
+func buildTenantLimitRange() (*corev1.LimitRange, error) {
+	defaults, err := parseResourceList(map[corev1.ResourceName]string{
+		corev1.ResourceCPU:    tenantConfig.DefaultCPULimit,
+		corev1.ResourceMemory: tenantConfig.DefaultMemoryLimit,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenant default limits: %w", err)
+	}
+	defaultRequests, err := parseResourceList(map[corev1.ResourceName]string{
+		corev1.ResourceCPU:    tenantConfig.DefaultCPURequest,
+		corev1.ResourceMemory: tenantConfig.DefaultMemoryRequest,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenant default requests: %w", err)
+	}
+
+	return &corev1.LimitRange{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: tenantLimitsName,
+		},
+		Spec: corev1.LimitRangeSpec{
+			Limits: []corev1.LimitRangeItem{
+				{
+					Type:           corev1.LimitTypeContainer,
+					Default:        defaults,
+					DefaultRequest: defaultRequests,
+				},
+			},
+		},
+	}, nil
+}
+
+func parseResourceList(values map[corev1.ResourceName]string) (corev1.ResourceList, error) {
+	list := corev1.ResourceList{}
+	for name, value := range values {
+		qty, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		list[name] = qty
+	}
+	return list, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	certManagerIssuerAnnotation        = "cert-manager.io/issuer"
+	certManagerClusterIssuerAnnotation = "cert-manager.io/cluster-issuer"
+	certManagerCertificateAnnotation   = "cert-manager.io/certificate-name"
+)
+
+func tlsSecretName(appName string) string {
+	return appName + "-tls"
+}
+
+// uploadsCertificate reports whether req brings its own certificate rather
+// than having cert-manager issue one.
+func uploadsCertificate(req *DeploymentRequest) bool {
+	return req.TLS != nil && req.TLS.Certificate != ""
+}
+
+// setIngressTLS terminates TLS for the hosts of req on ingress. The
+// certificate is read from the app TLS secret, which either holds the
+// uploaded certificate or is issued into by cert-manager.
+func setIngressTLS(ingress *networkingv1.Ingress, req *DeploymentRequest) {
+	if req.TLS == nil {
+		return
+	}
+
+	ingress.Spec.TLS = []networkingv1.IngressTLS{
+		{
+			Hosts:      ingressHosts(req),
+			SecretName: tlsSecretName(req.AppName),
+		},
+	}
+
+	if req.TLS.Issuer != "" {
+		metav1.SetMetaDataAnnotation(&ingress.ObjectMeta, certManagerIssuerAnnotation, req.TLS.Issuer)
+	}
+	if req.TLS.ClusterIssuer != "" {
+		metav1.SetMetaDataAnnotation(&ingress.ObjectMeta, certManagerClusterIssuerAnnotation, req.TLS.ClusterIssuer)
+	}
+}
+
+func buildTLSSecret(req *DeploymentRequest) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   tlsSecretName(req.AppName),
+			Labels: appLabels(req),
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			corev1.TLSCertKey:       []byte(req.TLS.Certificate),
+			corev1.TLSPrivateKeyKey: []byte(req.TLS.PrivateKey),
+		},
+	}
+}
+
+func createTLSSecret(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	secret := buildTLSSecret(req)
+	fmt.Println("Creating TLS secret...")
+	_, err := clientset.CoreV1().Secrets(namespace).Create(context.TODO(), secret, metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// reconcileTLSSecret stores the uploaded certificate of req in the app TLS
+// secret. Once no certificate is uploaded anymore, the secret is deleted
+// unless cert-manager has taken it over.
+func reconcileTLSSecret(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	secretsClient := clientset.CoreV1().Secrets(namespace)
+	secret, err := secretsClient.Get(context.TODO(), tlsSecretName(req.AppName), metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error fetching TLS secret: %w", err)
+	}
+	exists := err == nil
+
+	if !uploadsCertificate(req) {
+		if !exists || secret.Annotations[certManagerCertificateAnnotation] != "" {
+			return nil
+		}
+		fmt.Println("Deleting TLS secret...")
+		err = secretsClient.Delete(context.TODO(), secret.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("error deleting TLS secret: %w", err)
+		}
+		return nil
+	}
+
+	if !exists {
+		return createTLSSecret(clientset, namespace, req)
+	}
+
+	secret.Data = buildTLSSecret(req).Data
+
+	fmt.Println("Updating TLS secret...")
+	_, err = secretsClient.Update(context.TODO(), secret, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("error updating TLS secret: %w", err)
+	}
+
+	return nil
+}
+
+// parseCertificate returns the leaf certificate of a PEM encoded chain.
+func parseCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM encoded certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// validateKeyPair checks that certificate and privateKey belong together and
+// that the certificate covers every host.
+func validateKeyPair(certificate string, privateKey string, hosts []string) error {
+	if _, err := tls.X509KeyPair([]byte(certificate), []byte(privateKey)); err != nil {
+		return err
+	}
+	cert, err := parseCertificate([]byte(certificate))
+	if err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		if host == "" {
+			continue
+		}
+		if err := cert.VerifyHostname(host); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getTLSInfo describes the certificate serving the ingress of appName, or
+// returns nil if the app is not exposed over TLS.
+func getTLSInfo(clientset *kubernetes.Clientset, namespace string, appName string) (*TLSInfo, error) {
+	ingress, err := clientset.NetworkingV1().Ingresses(namespace).Get(context.TODO(), ingressName(appName), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching ingress: %v", err)
+	}
+	if len(ingress.Spec.TLS) == 0 {
+		return nil, nil
+	}
+
+	info := &TLSInfo{
+		SecretName:    ingress.Spec.TLS[0].SecretName,
+		Hosts:         ingress.Spec.TLS[0].Hosts,
+		Issuer:        ingress.Annotations[certManagerIssuerAnnotation],
+		ClusterIssuer: ingress.Annotations[certManagerClusterIssuerAnnotation],
+	}
+
+	// cert-manager may not have issued the certificate yet
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(context.TODO(), info.SecretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return info, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error fetching TLS secret: %v", err)
+	}
+
+	cert, err := parseCertificate(secret.Data[corev1.TLSCertKey])
+	if err != nil {
+		return info, nil
+	}
+	notAfter := metav1.NewTime(cert.NotAfter)
+	info.NotAfter = &notAfter
+	info.DNSNames = cert.DNSNames
+
+	return info, nil
+}
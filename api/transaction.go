@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// TransactionError is returned when one step of creating an app fails. It
+// names the failed step and lists the objects that were rolled back.
+type TransactionError struct {
+	FailedStep     string   `json:"failedStep"`
+	Message        string   `json:"error"`
+	RolledBack     []string `json:"rolledBack"`
+	RollbackErrors []string `json:"rollbackErrors,omitempty"`
+
+	err error
+}
+
+func (e *TransactionError) Error() string {
+	return fmt.Sprintf("error creating %s: %v", e.FailedStep, e.err)
+}
+
+func (e *TransactionError) Unwrap() error {
+	return e.err
+}
+
+// transaction keeps track of the objects created for a single request so
+// they can all be removed again when a later step fails.
+type transaction struct {
+	clientset *kubernetes.Clientset
+	namespace string
+	created   []createdObject
+}
+
+type createdObject struct {
+	kind string
+	name string
+}
+
+func newTransaction(clientset *kubernetes.Clientset, namespace string) *transaction {
+	return &transaction{clientset: clientset, namespace: namespace}
+}
+
+// do runs create, which is expected to create the object kind/name. On
+// failure every object created by earlier steps is deleted in reverse order
+// and a *TransactionError describing the rollback is returned.
+func (t *transaction) do(kind string, name string, create func() error) error {
+	err := create()
+	if err == nil {
+		t.created = append(t.created, createdObject{kind: kind, name: name})
+		return nil
+	}
+
+	return t.fail(kind, name, err)
+}
+
+// fail deletes every object created so far in reverse order after the step
+// on kind/name failed with err, and returns a *TransactionError describing
+// the rollback. It is used directly by steps that change an object created
+// earlier rather than create one.
+func (t *transaction) fail(kind string, name string, err error) error {
+	txErr := &TransactionError{
+		FailedStep: kind + "/" + name,
+		Message:    err.Error(),
+		RolledBack: make([]string, 0),
+		err:        err,
+	}
+
+	for i := len(t.created) - 1; i >= 0; i-- {
+		object := t.created[i]
+		fmt.Printf("Rolling back %s/%s...\n", object.kind, object.name)
+		rollbackErr := deleteObject(t.clientset, t.namespace, object.kind, object.name)
+		if rollbackErr != nil {
+			txErr.RollbackErrors = append(txErr.RollbackErrors, rollbackErr.Error())
+			continue
+		}
+		txErr.RolledBack = append(txErr.RolledBack, object.kind+"/"+object.name)
+	}
+	t.created = nil
+
+	return txErr
+}
+
+// deleteObject deletes a single object generated by the API, letting the
+// garbage collector remove the objects it owns in the background.
+func deleteObject(clientset *kubernetes.Clientset, namespace string, kind string, name string) error {
+	propagation := metav1.DeletePropagationBackground
+	opts := metav1.DeleteOptions{PropagationPolicy: &propagation}
+
+	var err error
+	switch kind {
+	case "deployment":
+		err = clientset.AppsV1().Deployments(namespace).Delete(context.TODO(), name, opts)
+	case "statefulset":
+		err = clientset.AppsV1().StatefulSets(namespace).Delete(context.TODO(), name, opts)
+	case "service":
+		err = clientset.CoreV1().Services(namespace).Delete(context.TODO(), name, opts)
+	case "ingress":
+		err = clientset.NetworkingV1().Ingresses(namespace).Delete(context.TODO(), name, opts)
+	case "secret":
+		err = clientset.CoreV1().Secrets(namespace).Delete(context.TODO(), name, opts)
+	case "configmap":
+		err = clientset.CoreV1().ConfigMaps(namespace).Delete(context.TODO(), name, opts)
+	case "horizontalpodautoscaler":
+		err = clientset.AutoscalingV2().HorizontalPodAutoscalers(namespace).Delete(context.TODO(), name, opts)
+	case "persistentvolumeclaim":
+		err = clientset.CoreV1().PersistentVolumeClaims(namespace).Delete(context.TODO(), name, opts)
+	case "job":
+		err = clientset.BatchV1().Jobs(namespace).Delete(context.TODO(), name, opts)
+	case "cronjob":
+		err = clientset.BatchV1().CronJobs(namespace).Delete(context.TODO(), name, opts)
+	default:
+		return fmt.Errorf("unknown object kind %s", kind)
+	}
+	if err != nil {
+		return fmt.Errorf("error deleting %s %s: %w", kind, name, err)
+	}
+
+	return nil
+}
@@ -2,23 +2,193 @@ package main
 
 import metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
+const configHashAnnotation = "kaasapi/config-hash"
+
 type DeploymentRequest struct {
-	AppName        string          `json:"appName"`
-	Replicas       int32           `json:"replicas"`
-	ImageAddress   string          `json:"imageAddress"`
-	ImageTag       string          `json:"imageTag"`
-	DomainAddress  string          `json:"domainAddress"`
-	ServicePort    int32           `json:"servicePort"`
-	Resources      ResourceRequest `json:"resources"`
-	Envs           []KeyValuePair  `json:"envs"`
-	Secrets        []KeyValuePair  `json:"secrets"`
-	ExternalAccess bool            `json:"ExternalAccess"`
+	AppName        string                `json:"appName"`
+	Replicas       int32                 `json:"replicas"`
+	ImageAddress   string                `json:"imageAddress"`
+	ImageTag       string                `json:"imageTag"`
+	DomainAddress  string                `json:"domainAddress"`
+	ServicePort    int32                 `json:"servicePort"`
+	Ports          []PortRequest         `json:"ports"`
+	ServiceType    string                `json:"serviceType"`
+	TLS            *TLSRequest           `json:"tls"`
+	Ingress        *IngressRequest       `json:"ingress"`
+	Resources      ResourceRequest       `json:"resources"`
+	Envs           []KeyValuePair        `json:"envs"`
+	Secrets        []KeyValuePair        `json:"secrets"`
+	ExternalAccess bool                  `json:"ExternalAccess"`
+	ChangeCause    string                `json:"changeCause"`
+	Autoscaling    *AutoscalingRequest   `json:"autoscaling"`
+	MountPath      string                `json:"mountPath"`
+	StorageClass   string                `json:"storageClass"`
+	Command        []string              `json:"command"`
+	Args           []string              `json:"args"`
+	WorkingDir     string                `json:"workingDir"`
+	Files          []FileMountRequest    `json:"files"`
+	Probes         ProbesRequest         `json:"probes"`
+	VolumeMounts   []VolumeMountRequest  `json:"volumeMounts"`
+	Sidecars       []ContainerRequest    `json:"sidecars"`
+	InitContainers []ContainerRequest    `json:"initContainers"`
+	SharedVolumes  []SharedVolumeRequest `json:"sharedVolumes"`
+	// ImagePullSecrets names registry credentials of the tenant to pull
+	// the images of the pod with.
+	ImagePullSecrets []string `json:"imagePullSecrets"`
+	// PinDigest resolves ImageTag to the digest it points to at deploy
+	// time, so the app keeps running that image even if the tag moves.
+	PinDigest bool `json:"pinDigest"`
+	// Release selects how an update is rolled out, see ReleaseRequest.
+	Release *ReleaseRequest `json:"release"`
+
+	// ImageDigest is the digest ImageTag was resolved to.
+	ImageDigest string `json:"-"`
+
+	// Tenant is set from the authenticated caller, never from the body.
+	Tenant string `json:"-"`
+}
+
+// ReleaseRequest selects the strategy an update of a running app is rolled
+// out with: rolling (the default), blueGreen or canary. A canary receives
+// CanaryWeight percent of the ingress traffic, 10 unless given. Releases
+// only roll out the pods, the service, ingress, TLS and basic auth of the
+// app must stay as they are. Apps are always created and applied directly.
+type ReleaseRequest struct {
+	Strategy     string `json:"strategy"`
+	CanaryWeight int32  `json:"canaryWeight"`
 }
 
 type ResourceRequest struct {
-	CPU  string `json:"cpu"`
-	RAM  string `json:"ram"`
-	Disk string `json:"disk"`
+	Preset   string `json:"preset"`
+	CPU      string `json:"cpu"`
+	RAM      string `json:"ram"`
+	CPULimit string `json:"cpuLimit"`
+	RAMLimit string `json:"ramLimit"`
+	Disk     string `json:"disk"`
+}
+
+type AutoscalingRequest struct {
+	MinReplicas       int32 `json:"minReplicas"`
+	MaxReplicas       int32 `json:"maxReplicas"`
+	CPUUtilization    int32 `json:"cpuUtilization"`
+	MemoryUtilization int32 `json:"memoryUtilization"`
+}
+
+// ProbesRequest configures the probes of the app container. Probes left out
+// default to a TCP check of the service port.
+type ProbesRequest struct {
+	Liveness  *ProbeRequest `json:"liveness"`
+	Readiness *ProbeRequest `json:"readiness"`
+	Startup   *ProbeRequest `json:"startup"`
+}
+
+// ProbeRequest is a single probe. Type is one of http, tcp, exec, grpc or
+// none, and zero timings keep their defaults.
+type ProbeRequest struct {
+	Type                string   `json:"type"`
+	Path                string   `json:"path"`
+	Port                int32    `json:"port"`
+	Scheme              string   `json:"scheme"`
+	Command             []string `json:"command"`
+	Service             string   `json:"service"`
+	InitialDelaySeconds int32    `json:"initialDelaySeconds"`
+	PeriodSeconds       int32    `json:"periodSeconds"`
+	TimeoutSeconds      int32    `json:"timeoutSeconds"`
+	SuccessThreshold    int32    `json:"successThreshold"`
+	FailureThreshold    int32    `json:"failureThreshold"`
+}
+
+// ContainerRequest is a sidecar or init container running next to the app
+// container in the same pod.
+type ContainerRequest struct {
+	Name         string               `json:"name"`
+	ImageAddress string               `json:"imageAddress"`
+	ImageTag     string               `json:"imageTag"`
+	Command      []string             `json:"command"`
+	Args         []string             `json:"args"`
+	Envs         []KeyValuePair       `json:"envs"`
+	Resources    ResourceRequest      `json:"resources"`
+	VolumeMounts []VolumeMountRequest `json:"volumeMounts"`
+}
+
+// SharedVolumeRequest is an emptyDir volume the containers of a pod can
+// share. Medium is empty for disk or "Memory" for tmpfs.
+type SharedVolumeRequest struct {
+	Name      string `json:"name"`
+	Medium    string `json:"medium"`
+	SizeLimit string `json:"sizeLimit"`
+}
+
+type VolumeMountRequest struct {
+	Name      string `json:"name"`
+	MountPath string `json:"mountPath"`
+	ReadOnly  bool   `json:"readOnly"`
+}
+
+// PortRequest is a named port of the app. TargetPort defaults to Port, and
+// NodePort is allocated by the cluster unless given.
+type PortRequest struct {
+	Name        string `json:"name"`
+	Port        int32  `json:"port"`
+	TargetPort  int32  `json:"targetPort"`
+	Protocol    string `json:"protocol"`
+	AppProtocol string `json:"appProtocol"`
+	NodePort    int32  `json:"nodePort"`
+}
+
+// TLSRequest terminates TLS for DomainAddress with either an uploaded PEM
+// certificate and key, or a certificate issued by a cert-manager Issuer or
+// ClusterIssuer.
+type TLSRequest struct {
+	Certificate   string `json:"certificate"`
+	PrivateKey    string `json:"privateKey"`
+	Issuer        string `json:"issuer"`
+	ClusterIssuer string `json:"clusterIssuer"`
+}
+
+// IngressRequest routes additional hosts and paths to the app and tunes the
+// ingress controller through a vetted set of options.
+type IngressRequest struct {
+	ClassName string               `json:"className"`
+	Hosts     []string             `json:"hosts"`
+	Paths     []IngressPathRequest `json:"paths"`
+	Options   IngressOptions       `json:"options"`
+}
+
+// IngressPathRequest routes a path to a service port, the primary port
+// unless given. PathType is Prefix, Exact or ImplementationSpecific.
+type IngressPathRequest struct {
+	Path     string `json:"path"`
+	PathType string `json:"pathType"`
+	Port     int32  `json:"port"`
+}
+
+type IngressOptions struct {
+	ProxyBodySize       string          `json:"proxyBodySize"`
+	ProxyConnectTimeout int32           `json:"proxyConnectTimeout"`
+	ProxyReadTimeout    int32           `json:"proxyReadTimeout"`
+	ProxySendTimeout    int32           `json:"proxySendTimeout"`
+	RewriteTarget       string          `json:"rewriteTarget"`
+	CORS                *CORSOptions    `json:"cors"`
+	BasicAuth           []BasicAuthUser `json:"basicAuth"`
+	AllowedSourceRanges []string        `json:"allowedSourceRanges"`
+}
+
+type CORSOptions struct {
+	AllowOrigins     []string `json:"allowOrigins"`
+	AllowMethods     []string `json:"allowMethods"`
+	AllowHeaders     []string `json:"allowHeaders"`
+	AllowCredentials bool     `json:"allowCredentials"`
+	MaxAge           int32    `json:"maxAge"`
+}
+
+type BasicAuthUser struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type ScaleRequest struct {
+	Replicas int32 `json:"replicas"`
 }
 
 type KeyValuePair struct {
@@ -27,10 +197,114 @@ type KeyValuePair struct {
 }
 
 type DeploymentInfo struct {
-	DeploymentName string      `json:"deploymentName"`
-	Replicas       int32       `json:"replicas"`
-	ReadyReplicas  int32       `json:"readyReplicas"`
-	PodStatuses    []PodStatus `json:"podStatuses"`
+	DeploymentName string       `json:"deploymentName"`
+	Kind           string       `json:"kind"`
+	Image          string       `json:"image"`
+	ImageTag       string       `json:"imageTag"`
+	ImageDigest    string       `json:"imageDigest,omitempty"`
+	QOSClass       string       `json:"qosClass"`
+	Replicas       int32        `json:"replicas"`
+	ReadyReplicas  int32        `json:"readyReplicas"`
+	Service        *ServiceInfo `json:"service,omitempty"`
+	TLS            *TLSInfo     `json:"tls,omitempty"`
+	Release        *ReleaseInfo `json:"release,omitempty"`
+	PodStatuses    []PodStatus  `json:"podStatuses"`
+}
+
+// ReleaseInfo describes a blue/green or canary release in progress.
+// Promoting is set once a blue/green release has taken over the traffic.
+type ReleaseInfo struct {
+	Strategy       string `json:"strategy"`
+	DeploymentName string `json:"deploymentName"`
+	Image          string `json:"image"`
+	ImageTag       string `json:"imageTag"`
+	ImageDigest    string `json:"imageDigest,omitempty"`
+	ChangeCause    string `json:"changeCause"`
+	Replicas       int32  `json:"replicas"`
+	ReadyReplicas  int32  `json:"readyReplicas"`
+	CanaryWeight   int32  `json:"canaryWeight,omitempty"`
+	Promoting      bool   `json:"promoting"`
+}
+
+type ServiceInfo struct {
+	Type                  string            `json:"type"`
+	ClusterIP             string            `json:"clusterIP"`
+	Ports                 []ServicePortInfo `json:"ports"`
+	LoadBalancerAddresses []string          `json:"loadBalancerAddresses,omitempty"`
+}
+
+type TLSInfo struct {
+	SecretName    string       `json:"secretName"`
+	Hosts         []string     `json:"hosts"`
+	Issuer        string       `json:"issuer,omitempty"`
+	ClusterIssuer string       `json:"clusterIssuer,omitempty"`
+	DNSNames      []string     `json:"dnsNames,omitempty"`
+	NotAfter      *metav1.Time `json:"notAfter,omitempty"`
+}
+
+type ServicePortInfo struct {
+	Name     string `json:"name,omitempty"`
+	Port     int32  `json:"port"`
+	Protocol string `json:"protocol"`
+	NodePort int32  `json:"nodePort,omitempty"`
+}
+
+type DeploymentRevision struct {
+	Revision    int64       `json:"revision"`
+	Image       string      `json:"image"`
+	ImageTag    string      `json:"imageTag"`
+	ImageDigest string      `json:"imageDigest,omitempty"`
+	ConfigHash  string      `json:"configHash"`
+	ChangeCause string      `json:"changeCause"`
+	CreatedAt   metav1.Time `json:"createdAt"`
+	Replicas    int32       `json:"replicas"`
+	Current     bool        `json:"current"`
+}
+
+type RollbackRequest struct {
+	Revision int64 `json:"revision"`
+}
+
+// LogRequest selects the logs of the app pods. Since is a duration such as
+// 10m, Tail the number of lines to start from and Follow keeps streaming
+// new lines as server-sent events.
+type LogRequest struct {
+	Container string `query:"container"`
+	Since     string `query:"since"`
+	Tail      *int64 `query:"tail"`
+	Follow    bool   `query:"follow"`
+}
+
+// ExecRequest is the command of an exec session, a shell in a terminal
+// unless given. Command is repeated in the query once per argument.
+type ExecRequest struct {
+	Container string   `query:"container"`
+	Command   []string `query:"command"`
+	TTY       bool     `query:"tty"`
+}
+
+// ExecStatus is the last message of an exec session.
+type ExecStatus struct {
+	ExitCode *int   `json:"exitCode,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// RunRequest runs Command with Args once in a copy of the app container.
+// The run is killed after TimeoutSeconds, an hour unless given.
+type RunRequest struct {
+	Command        []string `json:"command"`
+	Args           []string `json:"args"`
+	TimeoutSeconds *int64   `json:"timeoutSeconds"`
+}
+
+// RunEvent is a line of the output of a run, streamed as newline delimited
+// JSON. The last event names the job and carries the exit code of the
+// command, or the error that ended the run.
+type RunEvent struct {
+	Log      string `json:"log,omitempty"`
+	Job      string `json:"job,omitempty"`
+	ExitCode *int32 `json:"exitCode,omitempty"`
+	Error    string `json:"error,omitempty"`
 }
 
 type PodStatus struct {
@@ -38,5 +312,99 @@ type PodStatus struct {
 	Phase     string      `json:"phase"`
 	HostIP    string      `json:"hostIP"`
 	PodIP     string      `json:"podIP"`
+	QOSClass  string      `json:"qosClass"`
 	StartTime metav1.Time `json:"startTime"`
 }
+
+type DeleteResult struct {
+	AppName         string   `json:"appName"`
+	Deleted         []string `json:"deleted"`
+	RetainedVolumes []string `json:"retainedVolumes,omitempty"`
+}
+
+// FileMountRequest mounts a single key of the app config map or secret as a
+// file at MountPath.
+type FileMountRequest struct {
+	Source    string `json:"source"`
+	Key       string `json:"key"`
+	MountPath string `json:"mountPath"`
+	Mode      *int32 `json:"mode"`
+}
+
+// RegistryCredentialRequest registers the credentials of a private registry
+// for the tenant. Server is the registry host as it appears in image
+// addresses, e.g. "ghcr.io" or "registry.example.com:5000".
+type RegistryCredentialRequest struct {
+	Name     string `json:"name"`
+	Server   string `json:"server"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email"`
+}
+
+type RegistryCredentialInfo struct {
+	Name      string      `json:"name"`
+	Server    string      `json:"server"`
+	Username  string      `json:"username"`
+	CreatedAt metav1.Time `json:"createdAt"`
+}
+
+// JobRequest runs a container to completion. Envs are set on the container
+// directly and secrets are stored in a secret owned by the job.
+type JobRequest struct {
+	Name                  string          `json:"name"`
+	ImageAddress          string          `json:"imageAddress"`
+	ImageTag              string          `json:"imageTag"`
+	Command               []string        `json:"command"`
+	Args                  []string        `json:"args"`
+	Envs                  []KeyValuePair  `json:"envs"`
+	Secrets               []KeyValuePair  `json:"secrets"`
+	Resources             ResourceRequest `json:"resources"`
+	ImagePullSecrets      []string        `json:"imagePullSecrets"`
+	BackoffLimit          *int32          `json:"backoffLimit"`
+	ActiveDeadlineSeconds *int64          `json:"activeDeadlineSeconds"`
+
+	// Tenant is set from the authenticated caller, never from the body.
+	Tenant string `json:"-"`
+}
+
+// CronJobRequest runs the job it embeds on Schedule, a standard five field
+// cron expression evaluated in TimeZone, UTC unless given.
+// ConcurrencyPolicy is one of Allow, Forbid or Replace.
+type CronJobRequest struct {
+	JobRequest
+	Schedule                   string `json:"schedule"`
+	TimeZone                   string `json:"timeZone"`
+	ConcurrencyPolicy          string `json:"concurrencyPolicy"`
+	Suspend                    bool   `json:"suspend"`
+	StartingDeadlineSeconds    *int64 `json:"startingDeadlineSeconds"`
+	SuccessfulJobsHistoryLimit *int32 `json:"successfulJobsHistoryLimit"`
+	FailedJobsHistoryLimit     *int32 `json:"failedJobsHistoryLimit"`
+}
+
+// JobInfo describes a job and its pods. Status is one of Pending, Running,
+// Succeeded or Failed, and CronJob names the cron job that started it.
+type JobInfo struct {
+	Name           string       `json:"name"`
+	CronJob        string       `json:"cronJob,omitempty"`
+	Image          string       `json:"image"`
+	Status         string       `json:"status"`
+	Active         int32        `json:"active"`
+	Succeeded      int32        `json:"succeeded"`
+	Failed         int32        `json:"failed"`
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+	PodStatuses    []PodStatus  `json:"podStatuses,omitempty"`
+}
+
+type CronJobInfo struct {
+	Name               string       `json:"name"`
+	Image              string       `json:"image"`
+	Schedule           string       `json:"schedule"`
+	TimeZone           string       `json:"timeZone,omitempty"`
+	ConcurrencyPolicy  string       `json:"concurrencyPolicy"`
+	Suspend            bool         `json:"suspend"`
+	LastScheduleTime   *metav1.Time `json:"lastScheduleTime,omitempty"`
+	LastSuccessfulTime *metav1.Time `json:"lastSuccessfulTime,omitempty"`
+	Runs               []JobInfo    `json:"runs,omitempty"`
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// updateDeployment reconciles every object generated for an existing app with
+// req. The Deployment or StatefulSet is updated in place, so a changed image,
+// config or secret rolls the pods out according to its update strategy,
+// unless req asks for a release, which runs the new pods next to the stable
+// ones on snapshots of their config instead.
+func updateDeployment(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	kind, err := liveWorkloadKind(clientset, namespace, req.AppName)
+	if err != nil {
+		return err
+	}
+	if kind != workloadKind(req) {
+		return errWorkloadKindChanged
+	}
+	if kind == "statefulset" {
+		err = checkStatefulSetDisk(clientset, namespace, req)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = checkHostCollisions(clientset, namespace, req)
+	if err != nil {
+		return err
+	}
+
+	err = checkRelease(clientset, namespace, req)
+	if err != nil {
+		return err
+	}
+
+	// releases leave everything shared with the stable pods as it is, the
+	// config included, until they are promoted
+	if isRelease(req) {
+		err = checkReleaseRouting(clientset, namespace, req)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = updateService(clientset, namespace, req)
+		if err != nil {
+			return err
+		}
+
+		err = reconcileTLSSecret(clientset, namespace, req)
+		if err != nil {
+			return err
+		}
+
+		err = reconcileBasicAuthSecret(clientset, namespace, req)
+		if err != nil {
+			return err
+		}
+
+		err = reconcileIngress(clientset, namespace, req)
+		if err != nil {
+			return err
+		}
+
+		err = reconcileSecret(clientset, namespace, req)
+		if err != nil {
+			return err
+		}
+
+		err = reconcileConfigMap(clientset, namespace, req)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = snapshotConfig(clientset, namespace, req)
+	if err != nil {
+		return err
+	}
+
+	err = reconcileHPA(clientset, namespace, req)
+	if err != nil {
+		return err
+	}
+
+	if kind == "statefulset" {
+		err = updateStatefulSet(clientset, namespace, req)
+		if err != nil {
+			return err
+		}
+		return pruneSnapshots(clientset, namespace, req.AppName)
+	}
+
+	if isRelease(req) {
+		err = reconcileRelease(clientset, namespace, req)
+		if err != nil {
+			return err
+		}
+		return pruneSnapshots(clientset, namespace, req.AppName)
+	}
+
+	err = reconcileDataClaim(clientset, namespace, req)
+	if err != nil {
+		return err
+	}
+
+	deploymentsClient := clientset.AppsV1().Deployments(namespace)
+	deployment, err := deploymentsClient.Get(context.TODO(), req.AppName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("deployment not found: %w", err)
+	}
+
+	// replicas of autoscaled apps belong to the HPA
+	desired := buildDeployment(req)
+	if req.Autoscaling == nil {
+		deployment.Spec.Replicas = desired.Spec.Replicas
+	}
+	deployment.Spec.Template = desired.Spec.Template
+	metav1.SetMetaDataAnnotation(&deployment.ObjectMeta, changeCauseAnnotation, changeCause(req))
+
+	fmt.Println("Updating deployment...")
+	_, err = deploymentsClient.Update(context.TODO(), deployment, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("error updating deployment: %w", err)
+	}
+
+	return pruneSnapshots(clientset, namespace, req.AppName)
+}
+
+func updateService(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	servicesClient := clientset.CoreV1().Services(namespace)
+	service, err := servicesClient.Get(context.TODO(), serviceName(req.AppName), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return createService(clientset, namespace, req)
+	}
+	if err != nil {
+		return fmt.Errorf("error fetching service: %w", err)
+	}
+
+	desired := buildService(req)
+	if serviceRecreateRequired(service, desired) {
+		fmt.Println("Recreating service...")
+		err = servicesClient.Delete(context.TODO(), service.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("error deleting service: %w", err)
+		}
+		return createService(clientset, namespace, req)
+	}
+
+	// Only the selector, ports and type are owned by the API, the allocated
+	// ClusterIP, node ports and the rest of the spec are kept as they are.
+	keepNodePorts(service, desired)
+	service.Spec.Selector = desired.Spec.Selector
+	service.Spec.Ports = desired.Spec.Ports
+	service.Spec.Type = desired.Spec.Type
+
+	fmt.Println("Updating service...")
+	_, err = servicesClient.Update(context.TODO(), service, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("error updating service: %w", err)
+	}
+
+	return nil
+}
+
+// reconcileIngress creates or updates the ingress of the app when
+// ExternalAccess is set and removes it otherwise.
+func reconcileIngress(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	ingressesClient := clientset.NetworkingV1().Ingresses(namespace)
+	ingress, err := ingressesClient.Get(context.TODO(), ingressName(req.AppName), metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error fetching ingress: %w", err)
+	}
+	exists := err == nil
+
+	if !req.ExternalAccess {
+		if !exists {
+			return nil
+		}
+		fmt.Println("Deleting ingress...")
+		err = ingressesClient.Delete(context.TODO(), ingress.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("error deleting ingress: %w", err)
+		}
+		return nil
+	}
+
+	if !exists {
+		return createIngress(clientset, namespace, req)
+	}
+
+	desired := buildIngress(req)
+	ingress.Spec = desired.Spec
+	for _, key := range ownedIngressAnnotations {
+		delete(ingress.Annotations, key)
+		if value, ok := desired.Annotations[key]; ok {
+			metav1.SetMetaDataAnnotation(&ingress.ObjectMeta, key, value)
+		}
+	}
+
+	fmt.Println("Updating ingress...")
+	_, err = ingressesClient.Update(context.TODO(), ingress, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("error updating ingress: %w", err)
+	}
+
+	return nil
+}
+
+// reconcileSecret makes the app secret hold exactly req.Secrets, deleting it
+// when no secrets are requested anymore.
+func reconcileSecret(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	secretsClient := clientset.CoreV1().Secrets(namespace)
+	secret, err := secretsClient.Get(context.TODO(), secretName(req.AppName), metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error fetching secret: %w", err)
+	}
+	exists := err == nil
+
+	if len(req.Secrets) == 0 {
+		if !exists {
+			return nil
+		}
+		err = secretsClient.Delete(context.TODO(), secret.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("error deleting secret: %w", err)
+		}
+		return nil
+	}
+
+	if !exists {
+		_, err = createSecret(clientset, namespace, req.AppName, keyValueMap(req.Secrets))
+		return err
+	}
+
+	secret.Data = nil
+	secret.StringData = keyValueMap(req.Secrets)
+
+	_, err = secretsClient.Update(context.TODO(), secret, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("error updating secret: %w", err)
+	}
+
+	return nil
+}
+
+// reconcileConfigMap makes the app config map hold exactly req.Envs, deleting
+// it when no envs are requested anymore.
+func reconcileConfigMap(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	configMapsClient := clientset.CoreV1().ConfigMaps(namespace)
+	configMap, err := configMapsClient.Get(context.TODO(), configMapName(req.AppName), metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("error fetching config map: %w", err)
+	}
+	exists := err == nil
+
+	if len(req.Envs) == 0 {
+		if !exists {
+			return nil
+		}
+		err = configMapsClient.Delete(context.TODO(), configMap.Name, metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("error deleting config map: %w", err)
+		}
+		return nil
+	}
+
+	if !exists {
+		_, err = createConfigMap(clientset, namespace, configMapName(req.AppName), keyValueMap(req.Envs))
+		return err
+	}
+
+	configMap.Data = keyValueMap(req.Envs)
+
+	_, err = configMapsClient.Update(context.TODO(), configMap, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("error updating config map: %w", err)
+	}
+
+	return nil
+}
@@ -2,107 +2,231 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"sort"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
 
-func getAllDeploymentsInfo(clientset *kubernetes.Clientset) ([]DeploymentInfo, error) {
-	deploymentList, err := clientset.AppsV1().Deployments(corev1.NamespaceDefault).List(context.TODO(), metav1.ListOptions{})
+// getAllDeploymentsInfo lists the apps in namespace, whether they run as a
+// Deployment or a StatefulSet. When tenant is set, apps labelled as owned by
+// another tenant are left out.
+func getAllDeploymentsInfo(clientset *kubernetes.Clientset, namespace string, tenant string) ([]DeploymentInfo, error) {
+	deploymentList, err := clientset.AppsV1().Deployments(namespace).List(context.TODO(), metav1.ListOptions{})
 	if err != nil {
 		return nil, fmt.Errorf("error listing deployments: %v", err)
 	}
+	statefulSetList, err := clientset.AppsV1().StatefulSets(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing statefulsets: %v", err)
+	}
 
 	deploymentsInfo := make([]DeploymentInfo, 0)
 	for _, deployment := range deploymentList.Items {
-		podList, err := clientset.CoreV1().Pods(corev1.NamespaceDefault).List(context.TODO(), metav1.ListOptions{
-			LabelSelector: fmt.Sprintf("app=%s", deployment.Labels["app"]),
-		})
+		if owner := deployment.Labels[tenantLabel]; tenant != "" && owner != "" && owner != tenant {
+			continue
+		}
+		// releases are reported with the app they belong to
+		if deployment.Labels[releaseOfLabel] != "" {
+			continue
+		}
+
+		info, err := deploymentInfo(clientset, namespace, &deployment)
 		if err != nil {
-			return nil, fmt.Errorf("error listing pods for deployment %s: %v", deployment.Name, err)
+			return nil, err
 		}
 
-		podStatuses := make([]PodStatus, 0)
-		for _, pod := range podList.Items {
-			podStatuses = append(podStatuses, PodStatus{
-				Name:      pod.Name,
-				Phase:     string(pod.Status.Phase),
-				HostIP:    pod.Status.HostIP,
-				PodIP:     pod.Status.PodIP,
-				StartTime: *pod.Status.StartTime,
-			})
+		fmt.Println(info)
 
-			fmt.Println(podStatuses)
+		deploymentsInfo = append(deploymentsInfo, *info)
+	}
+	for _, statefulSet := range statefulSetList.Items {
+		if owner := statefulSet.Labels[tenantLabel]; tenant != "" && owner != "" && owner != tenant {
+			continue
 		}
 
-		deploymentInfo := DeploymentInfo{
-			DeploymentName: deployment.Name,
-			Replicas:       *deployment.Spec.Replicas,
-			ReadyReplicas:  deployment.Status.ReadyReplicas,
-			PodStatuses:    podStatuses,
+		info, err := statefulSetInfo(clientset, namespace, &statefulSet)
+		if err != nil {
+			return nil, err
 		}
 
-		fmt.Println(deploymentInfo)
+		fmt.Println(info)
 
-		deploymentsInfo = append(deploymentsInfo, deploymentInfo)
+		deploymentsInfo = append(deploymentsInfo, *info)
 	}
 
 	return deploymentsInfo, nil
 }
 
-func getDeploymentInfo(clientset *kubernetes.Clientset, appName string) (*DeploymentInfo, error) {
-	deployment, err := clientset.AppsV1().Deployments(corev1.NamespaceDefault).Get(context.TODO(), appName, metav1.GetOptions{})
+func getDeploymentInfo(clientset *kubernetes.Clientset, namespace string, appName string) (*DeploymentInfo, error) {
+	deployment, err := clientset.AppsV1().Deployments(namespace).Get(context.TODO(), appName, metav1.GetOptions{})
+	if err == nil {
+		return deploymentInfo(clientset, namespace, deployment)
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("error fetching deployment: %v", err)
+	}
+
+	statefulSet, err := clientset.AppsV1().StatefulSets(namespace).Get(context.TODO(), appName, metav1.GetOptions{})
 	if err != nil {
 		return nil, fmt.Errorf("deployment not found: %v", err)
 	}
+	return statefulSetInfo(clientset, namespace, statefulSet)
+}
 
-	podList, err := clientset.CoreV1().Pods(corev1.NamespaceDefault).List(context.TODO(), metav1.ListOptions{
-		LabelSelector: fmt.Sprintf("app=%s", deployment.Labels["app"]),
-	})
+func deploymentInfo(clientset *kubernetes.Clientset, namespace string, deployment *appsv1.Deployment) (*DeploymentInfo, error) {
+	podStatuses, err := getPodStatuses(clientset, namespace, deployment.Labels["app"])
 	if err != nil {
-		return nil, fmt.Errorf("error listing pods: %v", err)
+		return nil, err
 	}
 
-	podStatuses := make([]PodStatus, 0)
-	for _, pod := range podList.Items {
-		podStatuses = append(podStatuses, PodStatus{
-			Name:      pod.Name,
-			Phase:     string(pod.Status.Phase),
-			HostIP:    pod.Status.HostIP,
-			PodIP:     pod.Status.PodIP,
-			StartTime: *pod.Status.StartTime,
-		})
+	service, err := getServiceInfo(clientset, namespace, deployment.Name)
+	if err != nil {
+		return nil, err
+	}
+	tls, err := getTLSInfo(clientset, namespace, deployment.Name)
+	if err != nil {
+		return nil, err
+	}
+	release, err := getReleaseInfo(clientset, namespace, deployment.Name)
+	if err != nil {
+		return nil, err
 	}
 
-	deploymentInfo := &DeploymentInfo{
+	image, tag, digest := templateImage(deployment.Name, &deployment.Spec.Template)
+
+	return &DeploymentInfo{
 		DeploymentName: deployment.Name,
+		Kind:           "Deployment",
+		Image:          image,
+		ImageTag:       tag,
+		ImageDigest:    digest,
+		QOSClass:       appQOSClass(podStatuses, &deployment.Spec.Template),
 		Replicas:       *deployment.Spec.Replicas,
 		ReadyReplicas:  deployment.Status.ReadyReplicas,
+		Service:        service,
+		TLS:            tls,
+		Release:        release,
+		PodStatuses:    podStatuses,
+	}, nil
+}
+
+func statefulSetInfo(clientset *kubernetes.Clientset, namespace string, statefulSet *appsv1.StatefulSet) (*DeploymentInfo, error) {
+	podStatuses, err := getPodStatuses(clientset, namespace, statefulSet.Labels["app"])
+	if err != nil {
+		return nil, err
+	}
+
+	service, err := getServiceInfo(clientset, namespace, statefulSet.Name)
+	if err != nil {
+		return nil, err
+	}
+	tls, err := getTLSInfo(clientset, namespace, statefulSet.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	image, tag, digest := templateImage(statefulSet.Name, &statefulSet.Spec.Template)
+
+	return &DeploymentInfo{
+		DeploymentName: statefulSet.Name,
+		Kind:           "StatefulSet",
+		Image:          image,
+		ImageTag:       tag,
+		ImageDigest:    digest,
+		QOSClass:       appQOSClass(podStatuses, &statefulSet.Spec.Template),
+		Replicas:       *statefulSet.Spec.Replicas,
+		ReadyReplicas:  statefulSet.Status.ReadyReplicas,
+		Service:        service,
+		TLS:            tls,
 		PodStatuses:    podStatuses,
+	}, nil
+}
+
+func getPodStatuses(clientset *kubernetes.Clientset, namespace string, appName string) ([]PodStatus, error) {
+	return listPodStatuses(clientset, namespace, fmt.Sprintf("app=%s", appName))
+}
+
+// listPodStatuses describes the pods in namespace matching selector.
+func listPodStatuses(clientset *kubernetes.Clientset, namespace string, selector string) ([]PodStatus, error) {
+	podList, err := clientset.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: selector,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing pods for %s: %v", selector, err)
 	}
 
-	return deploymentInfo, nil
+	podStatuses := make([]PodStatus, 0)
+	for _, pod := range podList.Items {
+		podStatus := PodStatus{
+			Name:     pod.Name,
+			Phase:    string(pod.Status.Phase),
+			HostIP:   pod.Status.HostIP,
+			PodIP:    pod.Status.PodIP,
+			QOSClass: string(pod.Status.QOSClass),
+		}
+		// pods waiting for their volume are not started yet
+		if pod.Status.StartTime != nil {
+			podStatus.StartTime = *pod.Status.StartTime
+		}
+		podStatuses = append(podStatuses, podStatus)
+	}
+
+	return podStatuses, nil
 }
 
-func createDeployment(clientset *kubernetes.Clientset, req *DeploymentRequest) error {
+// createDeployment creates the app described by req and every object it
+// needs. Creation is all-or-nothing: when a step fails, the objects created
+// by earlier steps are removed and a *TransactionError is returned.
+func createDeployment(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	err := checkHostCollisions(clientset, namespace, req)
+	if err != nil {
+		return err
+	}
 
-	fmt.Println(req)
+	tx := newTransaction(clientset, namespace)
 
 	// Create service
-	err := createService(clientset, req)
+	err = tx.do("service", serviceName(req.AppName), func() error {
+		return createService(clientset, namespace, req)
+	})
 	if err != nil {
 		return err
 	}
 
+	// an uploaded certificate has to be in place before the ingress uses it
+	if req.ExternalAccess && uploadsCertificate(req) {
+		err = tx.do("secret", tlsSecretName(req.AppName), func() error {
+			return createTLSSecret(clientset, namespace, req)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if usesBasicAuth(req) {
+		err = tx.do("secret", basicAuthSecretName(req.AppName), func() error {
+			return createBasicAuthSecret(clientset, namespace, req)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
 	// ExternalAccess True, create ingress object
 	if req.ExternalAccess {
-		err = createIngress(clientset, req)
+		err = tx.do("ingress", ingressName(req.AppName), func() error {
+			return createIngress(clientset, namespace, req)
+		})
 		if err != nil {
 			return err
 		}
@@ -110,123 +234,238 @@ func createDeployment(clientset *kubernetes.Clientset, req *DeploymentRequest) e
 
 	// create secrets if requested
 	if len(req.Secrets) > 0 {
-		secretName := fmt.Sprintf("%v-secret", req.AppName)
-		secretsMap := make(map[string]string)
-		for _, kv := range req.Secrets {
-			secretsMap[kv.Key] = kv.Value
+		err = tx.do("secret", secretName(req.AppName), func() error {
+			_, err := createSecret(clientset, namespace, req.AppName, keyValueMap(req.Secrets))
+			return err
+		})
+		if err != nil {
+			return err
 		}
-		_, err := createSecret(clientset, secretName, secretsMap)
+	}
+
+	// create configs if requested
+	if len(req.Envs) > 0 {
+		err = tx.do("configmap", configMapName(req.AppName), func() error {
+			_, err := createConfigMap(clientset, namespace, configMapName(req.AppName), keyValueMap(req.Envs))
+			return err
+		})
 		if err != nil {
 			return err
 		}
 	}
 
-	// create secrets if requested
+	// keep the config of this revision for later rollbacks
 	if len(req.Envs) > 0 {
-		configMapName := fmt.Sprintf("%v-config", req.AppName)
-		configsMap := make(map[string]string)
-		for _, kv := range req.Envs {
-			configsMap[kv.Key] = kv.Value
+		err = tx.do("configmap", configSnapshotName(req.AppName, configHash(req)), func() error {
+			return createConfigSnapshot(clientset, namespace, req)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if len(req.Secrets) > 0 {
+		err = tx.do("secret", secretSnapshotName(req.AppName, configHash(req)), func() error {
+			return createSecretSnapshot(clientset, namespace, req)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if usesStatefulSet(req) {
+		// every pod gets its own claim from the StatefulSet
+		err = tx.do("statefulset", req.AppName, func() error {
+			return createStatefulSet(clientset, namespace, req)
+		})
+		if err != nil {
+			return err
 		}
-		_, err := createConfigMap(clientset, configMapName, configsMap)
+	} else {
+		if req.Resources.Disk != "" {
+			err = tx.do("persistentvolumeclaim", dataClaimName(req.AppName), func() error {
+				return createDataClaim(clientset, namespace, req)
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		deployment := buildDeployment(req)
+
+		deploymentsClient := clientset.AppsV1().Deployments(namespace)
+		err = tx.do("deployment", req.AppName, func() error {
+			fmt.Println("Creating deployment...")
+			_, err := deploymentsClient.Create(context.TODO(), deployment, metav1.CreateOptions{})
+			return err
+		})
 		if err != nil {
 			return err
 		}
 	}
 
+	// autoscaling requested, create HPA object
+	if req.Autoscaling != nil {
+		err = tx.do("horizontalpodautoscaler", hpaName(req.AppName), func() error {
+			return createHPA(clientset, namespace, req)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func buildDeployment(req *DeploymentRequest) *appsv1.Deployment {
 	deployment := &appsv1.Deployment{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: req.AppName,
+			Name:   req.AppName,
+			Labels: appLabels(req),
+			Annotations: map[string]string{
+				changeCauseAnnotation: changeCause(req),
+			},
 		},
 		Spec: appsv1.DeploymentSpec{
-			Replicas: int32Ptr(req.Replicas),
+			Replicas: int32Ptr(initialReplicas(req)),
 			Selector: &metav1.LabelSelector{
 				MatchLabels: map[string]string{
 					"app": req.AppName,
 				},
 			},
-			Template: corev1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
-						"app": req.AppName,
-					},
+			Strategy: appsv1.DeploymentStrategy{
+				Type: appsv1.RollingUpdateDeploymentStrategyType,
+			},
+			Template: buildPodTemplate(req),
+		},
+	}
+
+	// A single pod owns the ReadWriteOnce data claim, so the old pod has to
+	// go away before the new one can mount it.
+	if req.Resources.Disk != "" {
+		deployment.Spec.Strategy.Type = appsv1.RecreateDeploymentStrategyType
+		deployment.Spec.Template.Spec.Volumes = append(deployment.Spec.Template.Spec.Volumes, corev1.Volume{
+			Name: dataVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: dataClaimName(req.AppName),
 				},
-				Spec: corev1.PodSpec{
-					Containers: []corev1.Container{
-						{
-							Name:  req.AppName,
-							Image: fmt.Sprintf("%s:%s", req.ImageAddress, req.ImageTag),
-							Ports: []corev1.ContainerPort{
-								{
-									ContainerPort: req.ServicePort,
-								},
-							},
-							Resources: corev1.ResourceRequirements{
-								Requests: corev1.ResourceList{
-									corev1.ResourceCPU:    resourceQuantity(req.Resources.CPU),
-									corev1.ResourceMemory: resourceQuantity(req.Resources.RAM),
-								},
-							},
+			},
+		})
+	}
 
-							// Conditionally add EnvFrom based on Secrets or Envs
-							EnvFrom: func() []corev1.EnvFromSource {
-								var envFromSources []corev1.EnvFromSource
-								if len(req.Secrets) > 0 {
-									secretName := fmt.Sprintf("%v-secret", req.AppName)
-									envFromSources = append(envFromSources, corev1.EnvFromSource{
-										SecretRef: &corev1.SecretEnvSource{
-											LocalObjectReference: corev1.LocalObjectReference{
-												Name: secretName,
-											},
-										},
-									})
-								}
-								if len(req.Envs) > 0 {
-									configMapName := fmt.Sprintf("%v-config", req.AppName)
-									envFromSources = append(envFromSources, corev1.EnvFromSource{
-										ConfigMapRef: &corev1.ConfigMapEnvSource{
-											LocalObjectReference: corev1.LocalObjectReference{
-												Name: configMapName,
-											},
-										},
-									})
-								}
-								return envFromSources
-							}(),
+	return deployment
+}
+
+// initialReplicas starts autoscaled apps within their bounds, the HPA takes
+// over from there.
+func initialReplicas(req *DeploymentRequest) int32 {
+	replicas := req.Replicas
+	if req.Autoscaling != nil && replicas < minReplicas(req) {
+		replicas = minReplicas(req)
+	}
+	return replicas
+}
+
+// buildPodTemplate builds the pods of the app, shared by the Deployment and
+// the StatefulSet an app can run as.
+func buildPodTemplate(req *DeploymentRequest) corev1.PodTemplateSpec {
+	container := corev1.Container{
+		Name:      req.AppName,
+		Image:     imageReference(req),
+		Ports:     buildContainerPorts(req),
+		Resources: resourceRequirements(&req.Resources),
+
+		// Conditionally add EnvFrom based on Secrets or Envs
+		EnvFrom: func() []corev1.EnvFromSource {
+			var envFromSources []corev1.EnvFromSource
+			if len(req.Secrets) > 0 {
+				envFromSources = append(envFromSources, corev1.EnvFromSource{
+					SecretRef: &corev1.SecretEnvSource{
+						LocalObjectReference: corev1.LocalObjectReference{
+							Name: secretName(req.AppName),
 						},
 					},
-				},
-			},
-		},
+				})
+			}
+			if len(req.Envs) > 0 {
+				envFromSources = append(envFromSources, corev1.EnvFromSource{
+					ConfigMapRef: &corev1.ConfigMapEnvSource{
+						LocalObjectReference: corev1.LocalObjectReference{
+							Name: configMapName(req.AppName),
+						},
+					},
+				})
+			}
+			return envFromSources
+		}(),
 	}
 
-	deploymentsClient := clientset.AppsV1().Deployments(corev1.NamespaceDefault)
-	fmt.Println("Creating deployment...")
-	_, err = deploymentsClient.Create(context.TODO(), deployment, metav1.CreateOptions{})
-	if err != nil {
-		return err
+	container.Command = req.Command
+	container.Args = req.Args
+	container.WorkingDir = req.WorkingDir
+	container.LivenessProbe, container.ReadinessProbe, container.StartupProbe = buildProbes(req)
+
+	fileVolumes, fileMounts := buildFileMounts(req)
+	container.VolumeMounts = append(buildVolumeMounts(req.VolumeMounts), fileMounts...)
+
+	if req.Resources.Disk != "" {
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      dataVolumeName,
+			MountPath: req.MountPath,
+		})
 	}
 
-	return nil
+	containers := []corev1.Container{container}
+	for i := range req.Sidecars {
+		containers = append(containers, buildContainer(&req.Sidecars[i]))
+	}
+	var initContainers []corev1.Container
+	for i := range req.InitContainers {
+		initContainers = append(initContainers, buildContainer(&req.InitContainers[i]))
+	}
+
+	// Envs and secrets are injected through EnvFrom, so their content is
+	// hashed into the template to roll the pods whenever it changes.
+	annotations := map[string]string{
+		configHashAnnotation: configHash(req),
+	}
+	for key, value := range imageAnnotations(req) {
+		annotations[key] = value
+	}
+
+	return corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{
+				"app": req.AppName,
+			},
+			Annotations: annotations,
+		},
+		Spec: corev1.PodSpec{
+			InitContainers:   initContainers,
+			Containers:       containers,
+			Volumes:          append(buildSharedVolumes(req.SharedVolumes), fileVolumes...),
+			ImagePullSecrets: buildImagePullSecrets(req.ImagePullSecrets),
+		},
+	}
 }
 
-func createSecret(clientset *kubernetes.Clientset, SecretName string, Secrets map[string]string) (*corev1.Secret, error) {
+func createSecret(clientset *kubernetes.Clientset, namespace string, SecretName string, Secrets map[string]string) (*corev1.Secret, error) {
 	secret := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: SecretName + "-secret",
+			Name: secretName(SecretName),
 		},
 		StringData: Secrets,
 	}
 
-	_, err := clientset.CoreV1().Secrets(corev1.NamespaceDefault).Create(context.TODO(), secret, metav1.CreateOptions{})
+	_, err := clientset.CoreV1().Secrets(namespace).Create(context.TODO(), secret, metav1.CreateOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("error creating secret: %v", err)
+		return nil, fmt.Errorf("error creating secret: %w", err)
 	}
 
 	return secret, nil
 }
 
-func createConfigMap(clientset *kubernetes.Clientset, configMapName string, envs map[string]string) (*corev1.ConfigMap, error) {
+func createConfigMap(clientset *kubernetes.Clientset, namespace string, configMapName string, envs map[string]string) (*corev1.ConfigMap, error) {
 	configMap := &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: configMapName,
@@ -234,31 +473,17 @@ func createConfigMap(clientset *kubernetes.Clientset, configMapName string, envs
 		Data: envs,
 	}
 
-	_, err := clientset.CoreV1().ConfigMaps(corev1.NamespaceDefault).Create(context.TODO(), configMap, metav1.CreateOptions{})
+	_, err := clientset.CoreV1().ConfigMaps(namespace).Create(context.TODO(), configMap, metav1.CreateOptions{})
 	if err != nil {
-		return nil, fmt.Errorf("error creating config map: %v", err)
+		return nil, fmt.Errorf("error creating config map: %w", err)
 	}
 
 	return configMap, nil
 }
 
-func createService(clientset *kubernetes.Clientset, req *DeploymentRequest) error {
-	service := &corev1.Service{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: req.AppName + "-service",
-		},
-		Spec: corev1.ServiceSpec{
-			Selector: map[string]string{
-				"app": req.AppName,
-			},
-			Ports: []corev1.ServicePort{
-				{
-					Port: req.ServicePort,
-				},
-			},
-		},
-	}
-	servicesClient := clientset.CoreV1().Services(corev1.NamespaceDefault)
+func createService(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	service := buildService(req)
+	servicesClient := clientset.CoreV1().Services(namespace)
 	fmt.Println("Creating service...")
 	_, err := servicesClient.Create(context.TODO(), service, metav1.CreateOptions{})
 	if err != nil {
@@ -268,42 +493,26 @@ func createService(clientset *kubernetes.Clientset, req *DeploymentRequest) erro
 	return nil
 }
 
-func createIngress(clientset *kubernetes.Clientset, req *DeploymentRequest) error {
-	ingress := &networkingv1.Ingress{
+func buildService(req *DeploymentRequest) *corev1.Service {
+	service := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: req.AppName + "-ingress",
+			Name:   serviceName(req.AppName),
+			Labels: appLabels(req),
 		},
-		Spec: networkingv1.IngressSpec{
-			Rules: []networkingv1.IngressRule{
-				{
-					Host: req.DomainAddress,
-					IngressRuleValue: networkingv1.IngressRuleValue{
-						HTTP: &networkingv1.HTTPIngressRuleValue{
-							Paths: []networkingv1.HTTPIngressPath{
-								{
-									PathType: func() *networkingv1.PathType {
-										pt := networkingv1.PathTypePrefix
-										return &pt
-									}(),
-									Path: "/",
-									Backend: networkingv1.IngressBackend{
-										Service: &networkingv1.IngressServiceBackend{
-											Name: req.AppName + "-service",
-											Port: networkingv1.ServiceBackendPort{
-												Number: req.ServicePort,
-											},
-										},
-									},
-								},
-							},
-						},
-					},
-				},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{
+				"app": req.AppName,
 			},
+			Ports: buildServicePorts(req),
 		},
 	}
+	setServiceType(&service.Spec, req)
+	return service
+}
 
-	ingressesClient := clientset.NetworkingV1().Ingresses(corev1.NamespaceDefault)
+func createIngress(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
+	ingress := buildIngress(req)
+	ingressesClient := clientset.NetworkingV1().Ingresses(namespace)
 	fmt.Println("Creating ingress...")
 	_, err := ingressesClient.Create(context.TODO(), ingress, metav1.CreateOptions{})
 	if err != nil {
@@ -312,10 +521,81 @@ func createIngress(clientset *kubernetes.Clientset, req *DeploymentRequest) erro
 	return nil
 }
 
+func buildIngress(req *DeploymentRequest) *networkingv1.Ingress {
+	ingress := &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   ingressName(req.AppName),
+			Labels: appLabels(req),
+		},
+		Spec: networkingv1.IngressSpec{
+			Rules: buildIngressRules(req),
+		},
+	}
+	setIngressOptions(ingress, req)
+	setIngressTLS(ingress, req)
+	return ingress
+}
+
 func int32Ptr(i int32) *int32 {
 	return &i
 }
 
+func serviceName(appName string) string {
+	return appName + "-service"
+}
+
+func ingressName(appName string) string {
+	return appName + "-ingress"
+}
+
+func secretName(appName string) string {
+	return appName + "-secret"
+}
+
+func configMapName(appName string) string {
+	return appName + "-config"
+}
+
+func keyValueMap(pairs []KeyValuePair) map[string]string {
+	m := make(map[string]string)
+	for _, kv := range pairs {
+		m[kv.Key] = kv.Value
+	}
+	return m
+}
+
+// configHash returns a short digest of the envs and secrets of req, used to
+// tell apart pod templates that only differ in their injected configuration.
+func configHash(req *DeploymentRequest) string {
+	h := sha256.New()
+	for _, pairs := range [][]KeyValuePair{req.Envs, req.Secrets} {
+		m := keyValueMap(pairs)
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(h, "%s=%s\n", k, m[k])
+		}
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:10]
+}
+
+// resourceRequests builds the requests of a container, leaving out the
+// resources that were not asked for so namespace defaults apply to them.
+func resourceRequests(resources *ResourceRequest) corev1.ResourceList {
+	requests := corev1.ResourceList{}
+	if resources.CPU != "" {
+		requests[corev1.ResourceCPU] = resourceQuantity(resources.CPU)
+	}
+	if resources.RAM != "" {
+		requests[corev1.ResourceMemory] = resourceQuantity(resources.RAM)
+	}
+	return requests
+}
+
 func resourceQuantity(value string) resource.Quantity {
 	qty, err := resource.ParseQuantity(value)
 	if err != nil {
@@ -324,7 +604,66 @@ func resourceQuantity(value string) resource.Quantity {
 	return qty
 }
 
-func postgresStatefulSet(clientSet *kubernetes.Clientset, req *DeploymentRequest) error {
+// createPostgres creates a ready-made postgres app whose password is stored
+// in the app secret. Like createDeployment, a failed step rolls back every
+// object created before it.
+func createPostgres(clientset *kubernetes.Clientset, namespace string, req *DeploymentRequest, postgresPassword string) error {
+	err := checkHostCollisions(clientset, namespace, req)
+	if err != nil {
+		return err
+	}
+
+	tx := newTransaction(clientset, namespace)
+
+	err = tx.do("secret", secretName(req.AppName), func() error {
+		_, err := createSecret(clientset, namespace, req.AppName, map[string]string{
+			"password": postgresPassword,
+		})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = tx.do("service", serviceName(req.AppName), func() error {
+		return createService(clientset, namespace, req)
+	})
+	if err != nil {
+		return err
+	}
+
+	if req.ExternalAccess {
+		err = tx.do("ingress", ingressName(req.AppName), func() error {
+			return createIngress(clientset, namespace, req)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.do("statefulset", req.AppName, func() error {
+		return postgresStatefulSet(clientset, namespace, req)
+	})
+}
+
+// postgresDefaultDisk is the size of the postgres data volume when no disk
+// is requested.
+const postgresDefaultDisk = "2Gi"
+
+// applyPostgresDefaults fills in the image, port and data volume of a
+// postgres app. The disk is set before the request is validated, since a
+// mount path is only accepted together with one.
+func applyPostgresDefaults(req *DeploymentRequest) {
+	req.ImageAddress = "postgres"
+	req.ImageTag = "13"
+	req.ServicePort = 5432
+	req.MountPath = "/var/lib/postgresql/data"
+	if req.Resources.Disk == "" {
+		req.Resources.Disk = postgresDefaultDisk
+	}
+}
+
+func postgresStatefulSet(clientSet *kubernetes.Clientset, namespace string, req *DeploymentRequest) error {
 
 	replicas := int32Ptr(1)
 
@@ -334,7 +673,8 @@ func postgresStatefulSet(clientSet *kubernetes.Clientset, req *DeploymentRequest
 			Kind:       "StatefulSet",
 		},
 		ObjectMeta: metav1.ObjectMeta{
-			Name: req.AppName,
+			Name:   req.AppName,
+			Labels: appLabels(req),
 		},
 		Spec: appsv1.StatefulSetSpec{
 			ServiceName: req.AppName,
@@ -365,7 +705,7 @@ func postgresStatefulSet(clientSet *kubernetes.Clientset, req *DeploymentRequest
 									ValueFrom: &corev1.EnvVarSource{
 										SecretKeyRef: &corev1.SecretKeySelector{
 											LocalObjectReference: corev1.LocalObjectReference{
-												Name: req.AppName + "-secret",
+												Name: secretName(req.AppName),
 											},
 											Key: "password",
 										},
@@ -388,12 +728,7 @@ func postgresStatefulSet(clientSet *kubernetes.Clientset, req *DeploymentRequest
 									MountPath: "/var/lib/postgresql/data",
 								},
 							},
-							Resources: corev1.ResourceRequirements{
-								Requests: corev1.ResourceList{
-									corev1.ResourceCPU:    resourceQuantity(req.Resources.CPU),
-									corev1.ResourceMemory: resourceQuantity(req.Resources.RAM),
-								},
-							},
+							Resources: resourceRequirements(&req.Resources),
 						},
 					},
 				},
@@ -409,7 +744,7 @@ func postgresStatefulSet(clientSet *kubernetes.Clientset, req *DeploymentRequest
 						},
 						Resources: corev1.VolumeResourceRequirements{
 							Requests: corev1.ResourceList{
-								corev1.ResourceStorage: resource.MustParse("2Gi"),
+								corev1.ResourceStorage: resourceQuantity(req.Resources.Disk),
 							},
 						},
 					},
@@ -418,7 +753,14 @@ func postgresStatefulSet(clientSet *kubernetes.Clientset, req *DeploymentRequest
 		},
 	}
 
-	statefulSetClient := clientSet.AppsV1().StatefulSets(corev1.NamespaceDefault)
+	if req.StorageClass != "" {
+		statefulSet.Spec.VolumeClaimTemplates[0].Spec.StorageClassName = &req.StorageClass
+	}
+
+	container := &statefulSet.Spec.Template.Spec.Containers[0]
+	container.LivenessProbe, container.ReadinessProbe, container.StartupProbe = buildProbes(req)
+
+	statefulSetClient := clientSet.AppsV1().StatefulSets(namespace)
 	fmt.Println("Creating deployment...")
 	_, err := statefulSetClient.Create(context.TODO(), statefulSet, metav1.CreateOptions{})
 	if err != nil {
@@ -0,0 +1,26 @@
+package main
+
+import "testing"
+
+func TestPostgresDefaultsWithoutDisk(t *testing.T) {
+	// the ready postgres endpoint only asks for a name
+	req := &DeploymentRequest{AppName: "db", Tenant: "team"}
+	applyPostgresDefaults(req)
+	applyRequestDefaults(req)
+
+	if err := validateDeploymentRequest(req); err != nil {
+		t.Fatalf("postgres request without disk is invalid: %v", err)
+	}
+	if req.Resources.Disk != postgresDefaultDisk {
+		t.Errorf("disk = %q, want %q", req.Resources.Disk, postgresDefaultDisk)
+	}
+}
+
+func TestPostgresDefaultsKeepDisk(t *testing.T) {
+	req := &DeploymentRequest{AppName: "db", Tenant: "team", Resources: ResourceRequest{Disk: "10Gi"}}
+	applyPostgresDefaults(req)
+
+	if req.Resources.Disk != "10Gi" {
+		t.Errorf("disk = %q, want 10Gi", req.Resources.Disk)
+	}
+}
@@ -0,0 +1,1002 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+const (
+	// maxAppNameLength leaves room for the suffixes of the derived object
+	// names, e.g. "<app>-service" must remain a valid DNS label.
+	maxAppNameLength = 50
+	maxReplicas      = 100
+)
+
+var (
+	// imageNameRegexp matches an image reference without tag or digest,
+	// e.g. "nginx", "ghcr.io/org/app" or "localhost:5000/app".
+	imageNameRegexp = regexp.MustCompile(`^(?:(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?)(?:\.(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]*[a-zA-Z0-9])?))*(?::[0-9]+)?/)?[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	imageTagRegexp  = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+
+	// The ingress options end up in controller annotations, so they are
+	// restricted to plain values that cannot smuggle in configuration.
+	bodySizeRegexp       = regexp.MustCompile(`^[0-9]+[kKmMgG]?$`)
+	rewriteTargetRegexp  = regexp.MustCompile(`^/[A-Za-z0-9/_.~$-]*$`)
+	corsOriginRegexp     = regexp.MustCompile(`^(\*|https?://(\*\.)?[A-Za-z0-9.-]+(:[0-9]+)?)$`)
+	httpTokenRegexp      = regexp.MustCompile(`^[A-Za-z0-9!#$%&'*+.^_|~-]+$`)
+	ingressPathRegexp    = regexp.MustCompile(`^/[A-Za-z0-9/_.~%()|$*+?^\[\]-]*$`)
+	plainPathRegexp      = regexp.MustCompile(`^/[A-Za-z0-9/_.~%-]*$`)
+	basicAuthUserRegexp  = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+	registryServerRegexp = regexp.MustCompile(`^(https?://)?[A-Za-z0-9.-]+(:[0-9]+)?(/[A-Za-z0-9._/-]*)?$`)
+)
+
+const maxIngressTimeout = 3600
+
+var corsMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+// FieldError describes a single invalid field of a request.
+type FieldError struct {
+	Field   string      `json:"field"`
+	Type    string      `json:"type"`
+	Value   interface{} `json:"value,omitempty"`
+	Message string      `json:"message"`
+}
+
+// ValidationError is returned with status 422 when a request has invalid
+// fields, listing every one of them.
+type ValidationError struct {
+	Errors []FieldError `json:"errors"`
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("request has %d invalid fields", len(e.Errors))
+}
+
+// toValidationError converts errs into a *ValidationError, or nil if empty.
+func toValidationError(errs field.ErrorList) *ValidationError {
+	if len(errs) == 0 {
+		return nil
+	}
+
+	result := &ValidationError{Errors: make([]FieldError, 0, len(errs))}
+	for _, err := range errs {
+		fieldError := FieldError{
+			Field:   err.Field,
+			Type:    string(err.Type),
+			Message: err.Detail,
+		}
+		if fieldError.Message == "" {
+			fieldError.Message = err.Type.String()
+		}
+		if err.Type != field.ErrorTypeRequired && err.Type != field.ErrorTypeInternal {
+			fieldError.Value = err.BadValue
+		}
+		result.Errors = append(result.Errors, fieldError)
+	}
+	return result
+}
+
+// applyRequestDefaults fills in what req leaves to the server, the
+// requests and limits of resource presets and the domain of the app.
+func applyRequestDefaults(req *DeploymentRequest) {
+	expandResourcePresets(req)
+	allocateDomain(req)
+}
+
+// validateDeploymentRequest checks req before anything is sent to the
+// cluster.
+func validateDeploymentRequest(req *DeploymentRequest) *ValidationError {
+	var errs field.ErrorList
+
+	errs = append(errs, validateAppName(req.AppName, field.NewPath("appName"))...)
+
+	errs = append(errs, validateImage(req.ImageAddress, req.ImageTag, field.NewPath("imageAddress"), field.NewPath("imageTag"))...)
+
+	if req.Replicas < 0 || req.Replicas > maxReplicas {
+		errs = append(errs, field.Invalid(field.NewPath("replicas"), req.Replicas, fmt.Sprintf("must be between 0 and %d", maxReplicas)))
+	}
+
+	errs = append(errs, validatePorts(req)...)
+	if req.TLS != nil {
+		errs = append(errs, validateTLS(req, field.NewPath("tls"))...)
+	}
+	if req.Ingress != nil {
+		errs = append(errs, validateIngress(req, field.NewPath("ingress"))...)
+	}
+
+	errs = append(errs, validateResources(&req.Resources, field.NewPath("resources"))...)
+	errs = append(errs, validateKeys(req.Envs, fileKeys(req.Files, fileSourceConfig), field.NewPath("envs"))...)
+	errs = append(errs, validateKeys(req.Secrets, fileKeys(req.Files, fileSourceSecret), field.NewPath("secrets"))...)
+	errs = append(errs, validateFiles(req, field.NewPath("files"))...)
+
+	if req.WorkingDir != "" && !path.IsAbs(req.WorkingDir) {
+		errs = append(errs, field.Invalid(field.NewPath("workingDir"), req.WorkingDir, "must be an absolute path"))
+	}
+
+	domainPath := field.NewPath("domainAddress")
+	if req.DomainAddress != "" {
+		errs = append(errs, validation.IsFullyQualifiedDomainName(domainPath, req.DomainAddress)...)
+	} else if req.ExternalAccess {
+		errs = append(errs, field.Required(domainPath, "required when ExternalAccess is set"))
+	}
+
+	if req.Autoscaling != nil {
+		errs = append(errs, validateAutoscaling(req, field.NewPath("autoscaling"))...)
+	}
+	if req.Release != nil {
+		errs = append(errs, validateRelease(req, field.NewPath("release"))...)
+	}
+
+	errs = append(errs, validateStorage(req)...)
+
+	errs = append(errs, validateContainers(req)...)
+
+	pullSecretsPath := field.NewPath("imagePullSecrets")
+	pullSecrets := make(map[string]bool)
+	for i, name := range req.ImagePullSecrets {
+		errs = append(errs, validateRegistryName(name, pullSecretsPath.Index(i))...)
+		if pullSecrets[name] {
+			errs = append(errs, field.Duplicate(pullSecretsPath.Index(i), name))
+		}
+		pullSecrets[name] = true
+	}
+
+	probesPath := field.NewPath("probes")
+	errs = append(errs, validateProbe(req.Probes.Liveness, probesPath.Child("liveness"), false)...)
+	errs = append(errs, validateProbe(req.Probes.Readiness, probesPath.Child("readiness"), true)...)
+	errs = append(errs, validateProbe(req.Probes.Startup, probesPath.Child("startup"), false)...)
+
+	return toValidationError(errs)
+}
+
+func validateJobRequest(req *JobRequest) *ValidationError {
+	return toValidationError(validateJob(req, validation.DNS1123LabelMaxLength))
+}
+
+func validateCronJobRequest(req *CronJobRequest) *ValidationError {
+	errs := validateJob(&req.JobRequest, maxCronJobNameLength)
+
+	schedulePath := field.NewPath("schedule")
+	if req.Schedule == "" {
+		errs = append(errs, field.Required(schedulePath, ""))
+	} else if _, err := cron.ParseStandard(req.Schedule); err != nil {
+		errs = append(errs, field.Invalid(schedulePath, req.Schedule, err.Error()))
+	}
+	if req.TimeZone != "" {
+		if _, err := time.LoadLocation(req.TimeZone); err != nil {
+			errs = append(errs, field.Invalid(field.NewPath("timeZone"), req.TimeZone, "must be an IANA time zone"))
+		}
+	}
+
+	policies := []string{string(batchv1.AllowConcurrent), string(batchv1.ForbidConcurrent), string(batchv1.ReplaceConcurrent)}
+	if req.ConcurrencyPolicy != "" && !slices.Contains(policies, req.ConcurrencyPolicy) {
+		errs = append(errs, field.NotSupported(field.NewPath("concurrencyPolicy"), req.ConcurrencyPolicy, policies))
+	}
+	if req.StartingDeadlineSeconds != nil && *req.StartingDeadlineSeconds <= 0 {
+		errs = append(errs, field.Invalid(field.NewPath("startingDeadlineSeconds"), *req.StartingDeadlineSeconds, "must be positive"))
+	}
+	limits := []struct {
+		name  string
+		value *int32
+	}{
+		{"successfulJobsHistoryLimit", req.SuccessfulJobsHistoryLimit},
+		{"failedJobsHistoryLimit", req.FailedJobsHistoryLimit},
+	}
+	for _, limit := range limits {
+		if limit.value != nil && *limit.value < 0 {
+			errs = append(errs, field.Invalid(field.NewPath(limit.name), *limit.value, "must not be negative"))
+		}
+	}
+
+	return toValidationError(errs)
+}
+
+// validateLogRequest checks req against the template of the app pods, so
+// the container asked for is one they run.
+func validateLogRequest(req *LogRequest, template *corev1.PodTemplateSpec) *ValidationError {
+	var errs field.ErrorList
+	if req.Container != "" {
+		var containers []string
+		for _, container := range slices.Concat(template.Spec.InitContainers, template.Spec.Containers) {
+			containers = append(containers, container.Name)
+		}
+		if !slices.Contains(containers, req.Container) {
+			errs = append(errs, field.NotSupported(field.NewPath("container"), req.Container, containers))
+		}
+	}
+	if req.Since != "" {
+		since, err := time.ParseDuration(req.Since)
+		if err != nil || since < time.Second {
+			errs = append(errs, field.Invalid(field.NewPath("since"), req.Since, "must be a duration of at least 1s"))
+		}
+	}
+	if req.Tail != nil && *req.Tail < 0 {
+		errs = append(errs, field.Invalid(field.NewPath("tail"), *req.Tail, "must not be negative"))
+	}
+	return toValidationError(errs)
+}
+
+func validateRunRequest(req *RunRequest) *ValidationError {
+	var errs field.ErrorList
+	if len(req.Command) == 0 {
+		errs = append(errs, field.Required(field.NewPath("command"), ""))
+	}
+	if req.TimeoutSeconds != nil && *req.TimeoutSeconds <= 0 {
+		errs = append(errs, field.Invalid(field.NewPath("timeoutSeconds"), *req.TimeoutSeconds, "must be positive"))
+	}
+	return toValidationError(errs)
+}
+
+// validateJob checks the fields a job and a cron job have in common.
+func validateJob(req *JobRequest, maxNameLength int) field.ErrorList {
+	var errs field.ErrorList
+
+	namePath := field.NewPath("name")
+	switch {
+	case req.Name == "":
+		errs = append(errs, field.Required(namePath, ""))
+	case len(req.Name) > maxNameLength:
+		errs = append(errs, field.TooLong(namePath, req.Name, maxNameLength))
+	default:
+		// the pods of a job are labelled with its name
+		for _, msg := range validation.IsDNS1123Label(req.Name) {
+			errs = append(errs, field.Invalid(namePath, req.Name, msg))
+		}
+	}
+
+	errs = append(errs, validateImage(req.ImageAddress, req.ImageTag, field.NewPath("imageAddress"), field.NewPath("imageTag"))...)
+	errs = append(errs, validateKeys(req.Envs, nil, field.NewPath("envs"))...)
+	errs = append(errs, validateKeys(req.Secrets, nil, field.NewPath("secrets"))...)
+
+	resourcesPath := field.NewPath("resources")
+	errs = append(errs, validateResources(&req.Resources, resourcesPath)...)
+	if req.Resources.Disk != "" {
+		errs = append(errs, field.Forbidden(resourcesPath.Child("disk"), "jobs have no data volume"))
+	}
+
+	pullSecretsPath := field.NewPath("imagePullSecrets")
+	for i, name := range req.ImagePullSecrets {
+		errs = append(errs, validateRegistryName(name, pullSecretsPath.Index(i))...)
+	}
+
+	if req.BackoffLimit != nil && *req.BackoffLimit < 0 {
+		errs = append(errs, field.Invalid(field.NewPath("backoffLimit"), *req.BackoffLimit, "must not be negative"))
+	}
+	if req.ActiveDeadlineSeconds != nil && *req.ActiveDeadlineSeconds <= 0 {
+		errs = append(errs, field.Invalid(field.NewPath("activeDeadlineSeconds"), *req.ActiveDeadlineSeconds, "must be positive"))
+	}
+
+	return errs
+}
+
+func validateRelease(req *DeploymentRequest, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	strategyPath := fldPath.Child("strategy")
+	if req.Release.Strategy != "" && !slices.Contains(releaseStrategies, req.Release.Strategy) {
+		errs = append(errs, field.NotSupported(strategyPath, req.Release.Strategy, releaseStrategies))
+	}
+	if req.Release.CanaryWeight < 0 || req.Release.CanaryWeight > 100 {
+		errs = append(errs, field.Invalid(fldPath.Child("canaryWeight"), req.Release.CanaryWeight, "must be between 0 and 100"))
+	}
+
+	if !isRelease(req) {
+		return errs
+	}
+	if req.Resources.Disk != "" {
+		errs = append(errs, field.Forbidden(strategyPath, "apps with a data volume cannot run two versions side by side"))
+	}
+	if releaseStrategy(req) == releaseCanary && !req.ExternalAccess {
+		errs = append(errs, field.Forbidden(strategyPath, "canary releases split the ingress traffic and require ExternalAccess"))
+	}
+	return errs
+}
+
+func validateRegistryCredentialRequest(req *RegistryCredentialRequest) *ValidationError {
+	var errs field.ErrorList
+	errs = append(errs, validateRegistryName(req.Name, field.NewPath("name"))...)
+	if req.Server == "" {
+		errs = append(errs, field.Required(field.NewPath("server"), ""))
+	} else if !registryServerRegexp.MatchString(req.Server) {
+		errs = append(errs, field.Invalid(field.NewPath("server"), req.Server, "must be a registry host with an optional port"))
+	}
+	if req.Username == "" {
+		errs = append(errs, field.Required(field.NewPath("username"), ""))
+	}
+	if req.Password == "" {
+		errs = append(errs, field.Required(field.NewPath("password"), ""))
+	}
+	return toValidationError(errs)
+}
+
+// validateRegistryName checks the name of a registry credential, which is
+// stored as a label value and in the name of its secret.
+func validateRegistryName(name string, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	if name == "" {
+		return append(errs, field.Required(fldPath, ""))
+	}
+	for _, msg := range validation.IsDNS1123Label(name) {
+		errs = append(errs, field.Invalid(fldPath, name, msg))
+	}
+	return errs
+}
+
+func validateScaleRequest(req *ScaleRequest) *ValidationError {
+	var errs field.ErrorList
+	if req.Replicas < 0 || req.Replicas > maxReplicas {
+		errs = append(errs, field.Invalid(field.NewPath("replicas"), req.Replicas, fmt.Sprintf("must be between 0 and %d", maxReplicas)))
+	}
+	return toValidationError(errs)
+}
+
+func validateImage(address string, tag string, imagePath *field.Path, tagPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	if address == "" {
+		errs = append(errs, field.Required(imagePath, ""))
+	} else if !imageNameRegexp.MatchString(address) {
+		errs = append(errs, field.Invalid(imagePath, address, "must be a valid image name, e.g. registry.example.com/org/app"))
+	}
+
+	if tag == "" {
+		errs = append(errs, field.Required(tagPath, ""))
+	} else if !imageTagRegexp.MatchString(tag) {
+		errs = append(errs, field.Invalid(tagPath, tag, "must be a valid image tag"))
+	}
+	return errs
+}
+
+func validateAppName(appName string, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	if appName == "" {
+		return append(errs, field.Required(fldPath, ""))
+	}
+	if len(appName) > maxAppNameLength {
+		errs = append(errs, field.TooLong(fldPath, appName, maxAppNameLength))
+	}
+	// service names are DNS-1035 labels, so the app name must be one too
+	for _, msg := range validation.IsDNS1035Label(appName) {
+		errs = append(errs, field.Invalid(fldPath, appName, msg))
+	}
+	// the objects of a release are named after the app with these suffixes
+	for _, suffix := range []string{releaseName("", releaseBlueGreen), releaseName("", releaseCanary)} {
+		if strings.HasSuffix(appName, suffix) {
+			errs = append(errs, field.Invalid(fldPath, appName, fmt.Sprintf("must not end in %q, which is reserved for releases", suffix)))
+		}
+	}
+	return errs
+}
+
+func validateResources(resources *ResourceRequest, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	quantities := []struct {
+		name  string
+		value string
+	}{
+		{"cpu", resources.CPU},
+		{"ram", resources.RAM},
+		{"cpuLimit", resources.CPULimit},
+		{"ramLimit", resources.RAMLimit},
+		{"disk", resources.Disk},
+	}
+	for _, q := range quantities {
+		errs = append(errs, validateQuantity(q.value, fldPath.Child(q.name))...)
+	}
+
+	if resources.Preset != "" {
+		if _, ok := resourcePresets[resources.Preset]; !ok {
+			errs = append(errs, field.NotSupported(fldPath.Child("preset"), resources.Preset, presetNames()))
+		}
+	}
+
+	// a request above its limit is rejected by the API server
+	limits := []struct {
+		name    string
+		request string
+		limit   string
+	}{
+		{"cpuLimit", resources.CPU, resources.CPULimit},
+		{"ramLimit", resources.RAM, resources.RAMLimit},
+	}
+	for _, l := range limits {
+		request, err := resource.ParseQuantity(l.request)
+		if err != nil {
+			continue
+		}
+		limit, err := resource.ParseQuantity(l.limit)
+		if err != nil {
+			continue
+		}
+		if limit.Cmp(request) < 0 {
+			errs = append(errs, field.Invalid(fldPath.Child(l.name), l.limit, "must not be lower than the request"))
+		}
+	}
+
+	return errs
+}
+
+func validateQuantity(value string, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	if value == "" {
+		return errs
+	}
+	qty, err := resource.ParseQuantity(value)
+	if err != nil {
+		return append(errs, field.Invalid(fldPath, value, "must be a valid quantity, e.g. 500m or 1Gi"))
+	}
+	if qty.Sign() < 0 {
+		errs = append(errs, field.Invalid(fldPath, value, "must not be negative"))
+	}
+	return errs
+}
+
+// validateKeys checks that pairs have unique keys usable as environment
+// variable names. Keys in fileKeys are only mounted as files and may be any
+// valid file name, such as nginx.conf. Only keys are reported, so secret
+// values never leak.
+func validateKeys(pairs []KeyValuePair, fileKeys map[string]bool, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	seen := make(map[string]bool)
+	for i, kv := range pairs {
+		keyPath := fldPath.Index(i).Child("key")
+		if kv.Key == "" {
+			errs = append(errs, field.Required(keyPath, ""))
+			continue
+		}
+		if seen[kv.Key] {
+			errs = append(errs, field.Duplicate(keyPath, kv.Key))
+		}
+		seen[kv.Key] = true
+		if fileKeys[kv.Key] {
+			for _, msg := range validation.IsConfigMapKey(kv.Key) {
+				errs = append(errs, field.Invalid(keyPath, kv.Key, msg))
+			}
+			continue
+		}
+		for _, msg := range validation.IsEnvVarName(kv.Key) {
+			errs = append(errs, field.Invalid(keyPath, kv.Key, msg))
+		}
+	}
+	return errs
+}
+
+func validateAutoscaling(req *DeploymentRequest, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	autoscaling := req.Autoscaling
+
+	if autoscaling.MinReplicas < 0 {
+		errs = append(errs, field.Invalid(fldPath.Child("minReplicas"), autoscaling.MinReplicas, "must not be negative"))
+	}
+	if autoscaling.MaxReplicas < 1 || autoscaling.MaxReplicas > maxReplicas {
+		errs = append(errs, field.Invalid(fldPath.Child("maxReplicas"), autoscaling.MaxReplicas, fmt.Sprintf("must be between 1 and %d", maxReplicas)))
+	} else if autoscaling.MaxReplicas < minReplicas(req) {
+		errs = append(errs, field.Invalid(fldPath.Child("maxReplicas"), autoscaling.MaxReplicas, "must not be lower than minReplicas"))
+	}
+
+	if autoscaling.CPUUtilization < 0 {
+		errs = append(errs, field.Invalid(fldPath.Child("cpuUtilization"), autoscaling.CPUUtilization, "must not be negative"))
+	}
+	if autoscaling.MemoryUtilization < 0 {
+		errs = append(errs, field.Invalid(fldPath.Child("memoryUtilization"), autoscaling.MemoryUtilization, "must not be negative"))
+	}
+
+	// utilization is relative to the requests, so they have to be set
+	cpuTarget := autoscaling.CPUUtilization > 0 || autoscaling.MemoryUtilization <= 0
+	if cpuTarget && req.Resources.CPU == "" {
+		errs = append(errs, field.Required(field.NewPath("resources", "cpu"), "required for CPU based autoscaling"))
+	}
+	if autoscaling.MemoryUtilization > 0 && req.Resources.RAM == "" {
+		errs = append(errs, field.Required(field.NewPath("resources", "ram"), "required for memory based autoscaling"))
+	}
+
+	return errs
+}
+
+// validateStorage checks the data volume settings, which only apply when a
+// disk is requested.
+func validateStorage(req *DeploymentRequest) field.ErrorList {
+	var errs field.ErrorList
+
+	mountPath := field.NewPath("mountPath")
+	storageClass := field.NewPath("storageClass")
+	if req.Resources.Disk == "" {
+		if req.MountPath != "" {
+			errs = append(errs, field.Forbidden(mountPath, "requires resources.disk"))
+		}
+		if req.StorageClass != "" {
+			errs = append(errs, field.Forbidden(storageClass, "requires resources.disk"))
+		}
+		return errs
+	}
+
+	if qty, err := resource.ParseQuantity(req.Resources.Disk); err == nil && qty.Sign() == 0 {
+		errs = append(errs, field.Invalid(field.NewPath("resources", "disk"), req.Resources.Disk, "must be greater than zero"))
+	}
+
+	if req.MountPath == "" {
+		errs = append(errs, field.Required(mountPath, "required when resources.disk is set"))
+	} else if !path.IsAbs(req.MountPath) || path.Clean(req.MountPath) == "/" {
+		errs = append(errs, field.Invalid(mountPath, req.MountPath, "must be an absolute path other than /"))
+	}
+
+	if req.StorageClass != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(req.StorageClass) {
+			errs = append(errs, field.Invalid(storageClass, req.StorageClass, msg))
+		}
+	}
+
+	return errs
+}
+
+// validateProbe checks a probe of the app container. Only readiness probes
+// may require more than one success in a row.
+func validateProbe(probe *ProbeRequest, fldPath *field.Path, readiness bool) field.ErrorList {
+	var errs field.ErrorList
+	if probe == nil {
+		return errs
+	}
+
+	switch probe.Type {
+	case probeHTTP:
+		if probe.Path != "" && !strings.HasPrefix(probe.Path, "/") {
+			errs = append(errs, field.Invalid(fldPath.Child("path"), probe.Path, "must start with /"))
+		}
+		if probe.Scheme != "" && probe.Scheme != string(corev1.URISchemeHTTP) && probe.Scheme != string(corev1.URISchemeHTTPS) {
+			errs = append(errs, field.NotSupported(fldPath.Child("scheme"), probe.Scheme, []string{string(corev1.URISchemeHTTP), string(corev1.URISchemeHTTPS)}))
+		}
+	case probeExec:
+		if len(probe.Command) == 0 {
+			errs = append(errs, field.Required(fldPath.Child("command"), "required for exec probes"))
+		}
+	case probeTCP, probeGRPC, probeNone:
+	case "":
+		return append(errs, field.Required(fldPath.Child("type"), ""))
+	default:
+		return append(errs, field.NotSupported(fldPath.Child("type"), probe.Type, probeTypes))
+	}
+
+	if probe.Port != 0 {
+		for _, msg := range validation.IsValidPortNum(int(probe.Port)) {
+			errs = append(errs, field.Invalid(fldPath.Child("port"), probe.Port, msg))
+		}
+	}
+
+	timings := []struct {
+		name  string
+		value int32
+	}{
+		{"initialDelaySeconds", probe.InitialDelaySeconds},
+		{"periodSeconds", probe.PeriodSeconds},
+		{"timeoutSeconds", probe.TimeoutSeconds},
+		{"successThreshold", probe.SuccessThreshold},
+		{"failureThreshold", probe.FailureThreshold},
+	}
+	for _, t := range timings {
+		if t.value < 0 {
+			errs = append(errs, field.Invalid(fldPath.Child(t.name), t.value, "must not be negative"))
+		}
+	}
+	if !readiness && probe.SuccessThreshold > 1 {
+		errs = append(errs, field.Invalid(fldPath.Child("successThreshold"), probe.SuccessThreshold, "must be 1 for liveness and startup probes"))
+	}
+
+	return errs
+}
+
+// validateContainers checks the sidecars, init containers and the shared
+// volumes they mount.
+func validateContainers(req *DeploymentRequest) field.ErrorList {
+	var errs field.ErrorList
+
+	volumes := make(map[string]bool)
+	if req.Resources.Disk != "" {
+		volumes[dataVolumeName] = true
+	}
+	volumesPath := field.NewPath("sharedVolumes")
+	for i, volume := range req.SharedVolumes {
+		volumePath := volumesPath.Index(i)
+		namePath := volumePath.Child("name")
+		switch {
+		case volume.Name == "":
+			errs = append(errs, field.Required(namePath, ""))
+		case volume.Name == dataVolumeName || volume.Name == configFilesVolumeName || volume.Name == secretFilesVolumeName:
+			errs = append(errs, field.Invalid(namePath, volume.Name, "is reserved for the volumes of the app"))
+		case volumes[volume.Name]:
+			errs = append(errs, field.Duplicate(namePath, volume.Name))
+		default:
+			for _, msg := range validation.IsDNS1123Label(volume.Name) {
+				errs = append(errs, field.Invalid(namePath, volume.Name, msg))
+			}
+			volumes[volume.Name] = true
+		}
+
+		if volume.Medium != "" && volume.Medium != string(corev1.StorageMediumMemory) {
+			errs = append(errs, field.NotSupported(volumePath.Child("medium"), volume.Medium, []string{"", string(corev1.StorageMediumMemory)}))
+		}
+		errs = append(errs, validateQuantity(volume.SizeLimit, volumePath.Child("sizeLimit"))...)
+	}
+
+	errs = append(errs, validateVolumeMounts(req.VolumeMounts, volumes, field.NewPath("volumeMounts"))...)
+
+	names := map[string]bool{req.AppName: true}
+	groups := []struct {
+		path       *field.Path
+		containers []ContainerRequest
+	}{
+		{field.NewPath("sidecars"), req.Sidecars},
+		{field.NewPath("initContainers"), req.InitContainers},
+	}
+	for _, group := range groups {
+		for i := range group.containers {
+			container := &group.containers[i]
+			containerPath := group.path.Index(i)
+
+			namePath := containerPath.Child("name")
+			switch {
+			case container.Name == "":
+				errs = append(errs, field.Required(namePath, ""))
+			case names[container.Name]:
+				errs = append(errs, field.Duplicate(namePath, container.Name))
+			default:
+				for _, msg := range validation.IsDNS1123Label(container.Name) {
+					errs = append(errs, field.Invalid(namePath, container.Name, msg))
+				}
+				names[container.Name] = true
+			}
+
+			errs = append(errs, validateImage(container.ImageAddress, container.ImageTag, containerPath.Child("imageAddress"), containerPath.Child("imageTag"))...)
+			errs = append(errs, validateKeys(container.Envs, nil, containerPath.Child("envs"))...)
+			errs = append(errs, validateResources(&container.Resources, containerPath.Child("resources"))...)
+			if container.Resources.Disk != "" {
+				errs = append(errs, field.Forbidden(containerPath.Child("resources", "disk"), "only the app container has a data volume"))
+			}
+			errs = append(errs, validateVolumeMounts(container.VolumeMounts, volumes, containerPath.Child("volumeMounts"))...)
+		}
+	}
+
+	return errs
+}
+
+func validateVolumeMounts(mounts []VolumeMountRequest, volumes map[string]bool, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	mountPaths := make(map[string]bool)
+	for i, mount := range mounts {
+		mountPath := fldPath.Index(i)
+		if mount.Name == "" {
+			errs = append(errs, field.Required(mountPath.Child("name"), ""))
+		} else if !volumes[mount.Name] {
+			errs = append(errs, field.NotFound(mountPath.Child("name"), mount.Name))
+		}
+
+		pathPath := mountPath.Child("mountPath")
+		if mount.MountPath == "" {
+			errs = append(errs, field.Required(pathPath, ""))
+		} else if !path.IsAbs(mount.MountPath) {
+			errs = append(errs, field.Invalid(pathPath, mount.MountPath, "must be an absolute path"))
+		} else if mountPaths[path.Clean(mount.MountPath)] {
+			errs = append(errs, field.Duplicate(pathPath, mount.MountPath))
+		}
+		mountPaths[path.Clean(mount.MountPath)] = true
+	}
+	return errs
+}
+
+// validateFiles checks that every file mount names a key of the app config
+// map or secret and a distinct absolute path.
+func validateFiles(req *DeploymentRequest, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	sources := map[string]map[string]string{
+		fileSourceConfig: keyValueMap(req.Envs),
+		fileSourceSecret: keyValueMap(req.Secrets),
+	}
+	mountPaths := make(map[string]bool)
+	for i, file := range req.Files {
+		filePath := fldPath.Index(i)
+
+		keys, ok := sources[file.Source]
+		if !ok {
+			errs = append(errs, field.NotSupported(filePath.Child("source"), file.Source, []string{fileSourceConfig, fileSourceSecret}))
+		} else if file.Key == "" {
+			errs = append(errs, field.Required(filePath.Child("key"), ""))
+		} else if _, ok := keys[file.Key]; !ok {
+			errs = append(errs, field.NotFound(filePath.Child("key"), file.Key))
+		}
+
+		pathPath := filePath.Child("mountPath")
+		if file.MountPath == "" {
+			errs = append(errs, field.Required(pathPath, ""))
+		} else if !path.IsAbs(file.MountPath) || path.Clean(file.MountPath) == "/" {
+			errs = append(errs, field.Invalid(pathPath, file.MountPath, "must be an absolute file path"))
+		} else if mountPaths[path.Clean(file.MountPath)] {
+			errs = append(errs, field.Duplicate(pathPath, file.MountPath))
+		}
+		mountPaths[path.Clean(file.MountPath)] = true
+
+		if file.Mode != nil && (*file.Mode < 0 || *file.Mode > 0777) {
+			errs = append(errs, field.Invalid(filePath.Child("mode"), *file.Mode, "must be between 0 and 0777 (decimal 511)"))
+		}
+	}
+	return errs
+}
+
+// validatePorts checks the service type and the ports of the app, which are
+// either the single ServicePort or the list of named Ports.
+func validatePorts(req *DeploymentRequest) field.ErrorList {
+	var errs field.ErrorList
+
+	typePath := field.NewPath("serviceType")
+	nodePorts := false
+	switch req.ServiceType {
+	case "", string(corev1.ServiceTypeClusterIP), serviceTypeHeadless:
+	case string(corev1.ServiceTypeNodePort), string(corev1.ServiceTypeLoadBalancer):
+		nodePorts = true
+	default:
+		errs = append(errs, field.NotSupported(typePath, req.ServiceType, serviceTypes))
+	}
+
+	servicePortPath := field.NewPath("servicePort")
+	if len(req.Ports) == 0 {
+		for _, msg := range validation.IsValidPortNum(int(req.ServicePort)) {
+			errs = append(errs, field.Invalid(servicePortPath, req.ServicePort, msg))
+		}
+		return errs
+	}
+
+	portsPath := field.NewPath("ports")
+	names := make(map[string]bool)
+	numbers := make(map[string]bool)
+	matched := req.ServicePort == 0
+	for i, port := range req.Ports {
+		portPath := portsPath.Index(i)
+
+		namePath := portPath.Child("name")
+		if port.Name == "" {
+			if len(req.Ports) > 1 {
+				errs = append(errs, field.Required(namePath, "required when there are several ports"))
+			}
+		} else if names[port.Name] {
+			errs = append(errs, field.Duplicate(namePath, port.Name))
+		} else {
+			for _, msg := range validation.IsValidPortName(port.Name) {
+				errs = append(errs, field.Invalid(namePath, port.Name, msg))
+			}
+			names[port.Name] = true
+		}
+
+		for _, msg := range validation.IsValidPortNum(int(port.Port)) {
+			errs = append(errs, field.Invalid(portPath.Child("port"), port.Port, msg))
+		}
+		if port.TargetPort != 0 {
+			for _, msg := range validation.IsValidPortNum(int(port.TargetPort)) {
+				errs = append(errs, field.Invalid(portPath.Child("targetPort"), port.TargetPort, msg))
+			}
+		}
+
+		protocolPath := portPath.Child("protocol")
+		if port.Protocol != "" && port.protocol() != corev1.ProtocolTCP && port.protocol() != corev1.ProtocolUDP {
+			errs = append(errs, field.NotSupported(protocolPath, port.Protocol, []string{string(corev1.ProtocolTCP), string(corev1.ProtocolUDP)}))
+		}
+		key := fmt.Sprintf("%d/%s", port.Port, port.protocol())
+		if numbers[key] {
+			errs = append(errs, field.Duplicate(portPath.Child("port"), key))
+		}
+		numbers[key] = true
+
+		if port.AppProtocol != "" {
+			for _, msg := range validation.IsQualifiedName(port.AppProtocol) {
+				errs = append(errs, field.Invalid(portPath.Child("appProtocol"), port.AppProtocol, msg))
+			}
+		}
+
+		if port.NodePort != 0 {
+			if !nodePorts {
+				errs = append(errs, field.Forbidden(portPath.Child("nodePort"), "requires serviceType NodePort or LoadBalancer"))
+			}
+			for _, msg := range validation.IsValidPortNum(int(port.NodePort)) {
+				errs = append(errs, field.Invalid(portPath.Child("nodePort"), port.NodePort, msg))
+			}
+		}
+
+		if port.Port == req.ServicePort {
+			matched = true
+		}
+	}
+	if !matched {
+		errs = append(errs, field.Invalid(servicePortPath, req.ServicePort, "must match one of ports"))
+	}
+
+	if req.ExternalAccess && primaryPort(req).protocol() != corev1.ProtocolTCP {
+		errs = append(errs, field.Invalid(servicePortPath, primaryPort(req).Port, "must be a TCP port to be exposed through the ingress"))
+	}
+
+	return errs
+}
+
+// validateTLS checks that exactly one way of getting a certificate is
+// chosen. Key material is never echoed back in errors.
+func validateTLS(req *DeploymentRequest, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	tlsRequest := req.TLS
+
+	if !req.ExternalAccess {
+		errs = append(errs, field.Forbidden(fldPath, "requires ExternalAccess"))
+	}
+
+	modes := 0
+	if tlsRequest.Certificate != "" || tlsRequest.PrivateKey != "" {
+		modes++
+		if tlsRequest.Certificate == "" {
+			errs = append(errs, field.Required(fldPath.Child("certificate"), "required with privateKey"))
+		} else if tlsRequest.PrivateKey == "" {
+			errs = append(errs, field.Required(fldPath.Child("privateKey"), "required with certificate"))
+		} else if err := validateKeyPair(tlsRequest.Certificate, tlsRequest.PrivateKey, ingressHosts(req)); err != nil {
+			errs = append(errs, field.Invalid(fldPath.Child("certificate"), nil, err.Error()))
+		}
+	}
+	issuers := []struct {
+		name  string
+		value string
+	}{
+		{"issuer", tlsRequest.Issuer},
+		{"clusterIssuer", tlsRequest.ClusterIssuer},
+	}
+	for _, issuer := range issuers {
+		if issuer.value == "" {
+			continue
+		}
+		modes++
+		for _, msg := range validation.IsDNS1123Subdomain(issuer.value) {
+			errs = append(errs, field.Invalid(fldPath.Child(issuer.name), issuer.value, msg))
+		}
+	}
+
+	switch {
+	case modes == 0:
+		errs = append(errs, field.Required(fldPath, "set certificate and privateKey, issuer or clusterIssuer"))
+	case modes > 1:
+		errs = append(errs, field.Invalid(fldPath, nil, "set only one of certificate and privateKey, issuer or clusterIssuer"))
+	}
+
+	return errs
+}
+
+// validateIngress checks the hosts, paths and options of the ingress.
+func validateIngress(req *DeploymentRequest, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	ingress := req.Ingress
+
+	if !req.ExternalAccess {
+		errs = append(errs, field.Forbidden(fldPath, "requires ExternalAccess"))
+	}
+
+	if ingress.ClassName != "" {
+		for _, msg := range validation.IsDNS1123Subdomain(ingress.ClassName) {
+			errs = append(errs, field.Invalid(fldPath.Child("className"), ingress.ClassName, msg))
+		}
+	}
+
+	hosts := map[string]bool{req.DomainAddress: true}
+	for i, host := range ingress.Hosts {
+		hostPath := fldPath.Child("hosts").Index(i)
+		if hosts[host] {
+			errs = append(errs, field.Duplicate(hostPath, host))
+			continue
+		}
+		hosts[host] = true
+		errs = append(errs, validation.IsFullyQualifiedDomainName(hostPath, host)...)
+	}
+
+	ports := make(map[int32]bool)
+	for _, port := range appPorts(req) {
+		if port.protocol() == corev1.ProtocolTCP {
+			ports[port.Port] = true
+		}
+	}
+	pathTypes := []string{string(networkingv1.PathTypePrefix), string(networkingv1.PathTypeExact), string(networkingv1.PathTypeImplementationSpecific)}
+	paths := make(map[string]bool)
+	for i, path := range ingress.Paths {
+		pathPath := fldPath.Child("paths").Index(i)
+		if !ingressPathRegexp.MatchString(path.Path) {
+			errs = append(errs, field.Invalid(pathPath.Child("path"), path.Path, "must be an absolute URL path"))
+		} else if isRegexPath(path) && path.PathType != string(networkingv1.PathTypeImplementationSpecific) {
+			errs = append(errs, field.Invalid(pathPath.Child("path"), path.Path, "regular expressions require pathType ImplementationSpecific"))
+		} else if paths[path.Path] {
+			errs = append(errs, field.Duplicate(pathPath.Child("path"), path.Path))
+		}
+		paths[path.Path] = true
+		if path.PathType != "" && !slices.Contains(pathTypes, path.PathType) {
+			errs = append(errs, field.NotSupported(pathPath.Child("pathType"), path.PathType, pathTypes))
+		}
+		if path.Port != 0 && !ports[path.Port] {
+			errs = append(errs, field.NotFound(pathPath.Child("port"), path.Port))
+		}
+	}
+
+	errs = append(errs, validateIngressOptions(&ingress.Options, fldPath.Child("options"))...)
+	return errs
+}
+
+func validateIngressOptions(options *IngressOptions, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+
+	if options.ProxyBodySize != "" && !bodySizeRegexp.MatchString(options.ProxyBodySize) {
+		errs = append(errs, field.Invalid(fldPath.Child("proxyBodySize"), options.ProxyBodySize, "must be a size like 8m or 1g"))
+	}
+
+	timeouts := []struct {
+		name    string
+		seconds int32
+	}{
+		{"proxyConnectTimeout", options.ProxyConnectTimeout},
+		{"proxyReadTimeout", options.ProxyReadTimeout},
+		{"proxySendTimeout", options.ProxySendTimeout},
+	}
+	for _, timeout := range timeouts {
+		if timeout.seconds < 0 || timeout.seconds > maxIngressTimeout {
+			errs = append(errs, field.Invalid(fldPath.Child(timeout.name), timeout.seconds, fmt.Sprintf("must be between 0 and %d seconds", maxIngressTimeout)))
+		}
+	}
+
+	if options.RewriteTarget != "" && !rewriteTargetRegexp.MatchString(options.RewriteTarget) {
+		errs = append(errs, field.Invalid(fldPath.Child("rewriteTarget"), options.RewriteTarget, "must be a URL path, optionally with capture groups like /$2"))
+	}
+
+	if cors := options.CORS; cors != nil {
+		corsPath := fldPath.Child("cors")
+		for i, origin := range cors.AllowOrigins {
+			if !corsOriginRegexp.MatchString(origin) {
+				errs = append(errs, field.Invalid(corsPath.Child("allowOrigins").Index(i), origin, "must be * or an origin like https://example.com"))
+			}
+		}
+		for i, method := range cors.AllowMethods {
+			if !slices.Contains(corsMethods, method) {
+				errs = append(errs, field.NotSupported(corsPath.Child("allowMethods").Index(i), method, corsMethods))
+			}
+		}
+		for i, header := range cors.AllowHeaders {
+			if !httpTokenRegexp.MatchString(header) {
+				errs = append(errs, field.Invalid(corsPath.Child("allowHeaders").Index(i), header, "must be a header name"))
+			}
+		}
+		if cors.MaxAge < 0 {
+			errs = append(errs, field.Invalid(corsPath.Child("maxAge"), cors.MaxAge, "must not be negative"))
+		}
+	}
+
+	usernames := make(map[string]bool)
+	for i, user := range options.BasicAuth {
+		userPath := fldPath.Child("basicAuth").Index(i)
+		if !basicAuthUserRegexp.MatchString(user.Username) {
+			errs = append(errs, field.Invalid(userPath.Child("username"), user.Username, "must consist of letters, digits, '.', '_' or '-'"))
+		} else if usernames[user.Username] {
+			errs = append(errs, field.Duplicate(userPath.Child("username"), user.Username))
+		}
+		usernames[user.Username] = true
+		// bcrypt only hashes the first 72 bytes
+		if user.Password == "" {
+			errs = append(errs, field.Required(userPath.Child("password"), ""))
+		} else if len(user.Password) > 72 {
+			errs = append(errs, field.TooLong(userPath.Child("password"), nil, 72))
+		}
+	}
+
+	for i, sourceRange := range options.AllowedSourceRanges {
+		if _, _, err := net.ParseCIDR(sourceRange); err != nil {
+			errs = append(errs, field.Invalid(fldPath.Child("allowedSourceRanges").Index(i), sourceRange, "must be a CIDR like 10.0.0.0/8"))
+		}
+	}
+
+	return errs
+}